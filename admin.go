@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// body of POST {Root}/admin/representations/{id}, everything else is read from the init segment
+type AdminRepresentation struct {
+	Pipe     string `json:"pipe"` // empty to feed the representation through the ingest endpoint only
+	Log      bool   `json:"log"`
+	LogLevel string `json:"log_level"`
+}
+
+// AdminHandler serves the admin API under {Root}/admin/, disabled (404) as long as no AdminToken is configured
+func AdminHandler(w http.ResponseWriter, r *http.Request) {
+	settings := config.Load()
+	if settings.Server.AdminToken == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !authorized(r, settings.Server.AdminToken) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ruddr admin"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case settings.Server.Root + "/admin/reload":
+		ReloadHandler(w, r)
+		return
+	case settings.Server.Root + "/admin/sign":
+		SignHandler(w, r)
+		return
+	case settings.Server.Root + "/admin/sessions":
+		CmcdHandler(w, r)
+		return
+	}
+	RepresentationsHandler(w, r, strings.TrimPrefix(r.URL.Path, settings.Server.Root+"/admin/"))
+}
+
+// RepresentationsHandler adds (POST) or removes (DELETE) a representation on {Root}/admin/representations/{id}
+// POST on an existing representation changes its pipe and log level, keeping its fragments
+// with channels configured, the channel is selected with ?channel={name}
+func RepresentationsHandler(w http.ResponseWriter, r *http.Request, path string) {
+	id, found := strings.CutPrefix(path, "representations/")
+	if !found || id == "" || strings.Contains(id, "/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	channel := findChannel(r.URL.Query().Get("channel"))
+	if channel == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Channel %s not found", r.URL.Query().Get("channel"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		var body AdminRepresentation
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Invalid representation: %s", err)
+			return
+		}
+		if _, err := parseLevel(body.LogLevel); body.LogLevel != "" && err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Invalid log level %q", body.LogLevel)
+			return
+		}
+		stream, created, err := channel.AddRepresentation(id, Representation{Pipe: body.Pipe, Log: body.Log, LogLevel: body.LogLevel})
+		if err != nil {
+			httpLog.Error("adding representation", "channel", channel.Name, "representation", id, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Error adding representation %s: %s", id, err)
+			return
+		}
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+			mainLog.Info("representation added", "channel", channel.Name, "representation", id, "pipe", body.Pipe)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(stream.Health(time.Now()))
+	case http.MethodDelete:
+		if !channel.RemoveRepresentation(id) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "Representation %s not found", id)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// SignHandler answers GET {Root}/admin/sign?prefix={path}&ttl={seconds}[&ip={address}] with the query of a signed URL
+func SignHandler(w http.ResponseWriter, r *http.Request) {
+	auth := config.Load().Auth
+	query := r.URL.Query()
+	ttl, err := strconv.ParseUint(query.Get("ttl"), 10, 32)
+	if auth.Secret == "" || err != nil || !strings.HasPrefix(query.Get("prefix"), "/") {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Secret not configured, or prefix and ttl missing")
+		return
+	}
+	exp := time.Now().Add(time.Duration(ttl) * time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(struct {
+		Query   string    `json:"query"`
+		Expires time.Time `json:"expires"`
+	}{
+		Query:   auth.Sign(query.Get("prefix"), exp, query.Get("ip")).Encode(),
+		Expires: exp.UTC().Truncate(time.Second),
+	})
+}
+
+// constant time comparison of the bearer token
+func authorized(r *http.Request, token string) bool {
+	given, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return found && token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// the channel with the given name, the only one when channels are not configured
+func findChannel(name string) *Channel {
+	for _, channel := range channels {
+		if channel.Name == name {
+			return channel
+		}
+	}
+	return nil
+}
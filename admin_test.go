@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAdminRepresentations(t *testing.T) {
+	server := newTestChannels(t, &Config{
+		Server:   Server{Root: "/live", AdminToken: "admin"},
+		Channels: map[string]*Channel{"a": {Representations: map[string]*Representation{"v": {}}}},
+	})
+	do := func(method, path, token, body string) (*http.Response, []byte) {
+		t.Helper()
+		r, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		response, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		data, _ := io.ReadAll(response.Body)
+		return response, data
+	}
+	manifest := func() map[string]*Representation {
+		t.Helper()
+		_, body := do(http.MethodGet, "/live/a/", "", "")
+		var manifest Manifest
+		if err := json.Unmarshal(body, &manifest); err != nil {
+			t.Fatal(err)
+		}
+		return manifest.Representations
+	}
+
+	if response, _ := do(http.MethodPost, "/live/admin/representations/new?channel=a", "", "{}"); response.StatusCode != http.StatusUnauthorized || manifest()["new"] != nil {
+		t.Errorf("add without the token: status %d", response.StatusCode)
+	}
+	response, body := do(http.MethodPost, "/live/admin/representations/new?channel=a", "admin", `{"log": true}`)
+	var health HealthStatus
+	json.Unmarshal(body, &health)
+	if response.StatusCode != http.StatusCreated || health.Channel != "a" || health.Representation != "new" || health.Ready {
+		t.Errorf("add: status %d, %s", response.StatusCode, body)
+	}
+	if representations := manifest(); len(representations) != 2 || representations["new"] == nil {
+		t.Errorf("representations after the add %v", representations)
+	}
+	if response, _ := do(http.MethodPost, "/live/a/ingest/new", "admin", string(testSource(4, 2))); response.StatusCode != http.StatusNoContent {
+		t.Errorf("ingest into the new representation: status %d", response.StatusCode)
+	}
+	if response, body := do(http.MethodGet, "/live/a/new/1", "", ""); response.StatusCode != http.StatusOK || !bytes.Equal(body, testSegment(1)) {
+		t.Errorf("segment 1 of the new representation: status %d, %d bytes", response.StatusCode, len(body))
+	}
+
+	// reconfigured in place, the fragments are kept
+	if response, body := do(http.MethodPost, "/live/admin/representations/new?channel=a", "admin", `{"log_level": "error"}`); response.StatusCode != http.StatusOK {
+		t.Errorf("update: status %d, %s", response.StatusCode, body)
+	}
+	if level := channels[0].stream("new").logLevel.Level(); level != slog.LevelError {
+		t.Errorf("log level %s after the update", level)
+	}
+	if response, _ := do(http.MethodGet, "/live/a/new/1", "", ""); response.StatusCode != http.StatusOK {
+		t.Errorf("segment 1 after the update: status %d", response.StatusCode)
+	}
+
+	for _, request := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodPost, "/live/admin/representations/new?channel=a", `{"log_level": "loud"}`, http.StatusBadRequest},
+		{http.MethodPost, "/live/admin/representations/new?channel=a", `{"pipe": `, http.StatusBadRequest},
+		{http.MethodPost, "/live/admin/representations/new?channel=b", "{}", http.StatusNotFound},
+		{http.MethodPost, "/live/admin/representations/new", "{}", http.StatusNotFound},
+		{http.MethodPost, "/live/admin/representations/", "{}", http.StatusNotFound},
+		{http.MethodPut, "/live/admin/representations/new?channel=a", "{}", http.StatusMethodNotAllowed},
+	} {
+		if response, body := do(request.method, request.path, "admin", request.body); response.StatusCode != request.status {
+			t.Errorf("%s %s %s: status %d, %s", request.method, request.path, request.body, response.StatusCode, body)
+		}
+	}
+
+	if response, _ := do(http.MethodDelete, "/live/admin/representations/new?channel=a", "admin", ""); response.StatusCode != http.StatusNoContent {
+		t.Errorf("remove: status %d", response.StatusCode)
+	}
+	if representations := manifest(); len(representations) != 1 || representations["v"] == nil {
+		t.Errorf("representations after the removal %v", representations)
+	}
+	if response, _ := do(http.MethodGet, "/live/a/new/1", "", ""); response.StatusCode != http.StatusNotFound {
+		t.Errorf("segment 1 of the removed representation: status %d", response.StatusCode)
+	}
+	if response, _ := do(http.MethodPost, "/live/a/ingest/new", "admin", string(testSource(4, 2))); response.StatusCode != http.StatusNotFound {
+		t.Errorf("ingest into the removed representation: status %d", response.StatusCode)
+	}
+	if response, _ := do(http.MethodDelete, "/live/admin/representations/new?channel=a", "admin", ""); response.StatusCode != http.StatusNotFound {
+		t.Errorf("second removal: status %d", response.StatusCode)
+	}
+
+	// without an AdminToken the API does not exist
+	settings := *config.Load()
+	settings.Server.AdminToken = ""
+	config.Store(&settings)
+	if response, _ := do(http.MethodPost, "/live/admin/representations/other?channel=a", "admin", "{}"); response.StatusCode != http.StatusNotFound || manifest()["other"] != nil {
+		t.Errorf("add without an AdminToken configured: status %d", response.StatusCode)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+type Archive struct {
+	Directory string // evicted fragments are moved to {Directory}/{reprId}, empty disables the archive
+	Window    uint32 // time-shift window kept on disk [seconds], 0 keeps everything
+}
+
+const ARCHIVE_QUEUE = 256 // fragments and init segments waiting to be written, the ingest never waits for the disk
+
+var (
+	ErrNotArchived     = errors.New("fragment not in the archive")
+	ErrNotSegmentStart = errors.New("fragment does not start a segment")
+	ErrArchiveBusy     = errors.New("archive queue full")
+)
+
+// StreamArchive is the on-disk tier of a representation: every fragment evicted from memory is written to
+// {seq}.m4s, every init segment to init-{generation}.mp4, and index.jsonl lists the archived fragments in order
+// files are written by a worker goroutine, a fragment is listed as soon as it is queued and opened once written
+type StreamArchive struct {
+	dir       string
+	window    uint32
+	mu        sync.RWMutex
+	fragments []*Fragment              // sorted by sequence number, without data
+	pending   map[uint32]chan struct{} // sequence -> closed once the fragment is written (or given up)
+	index     *os.File
+	queue     chan archiveJob
+	done      chan struct{} // closed when the worker has written the queue out
+}
+
+// a fragment, whose data the archive now owns, or an init segment to be written
+type archiveJob struct {
+	frag       *Fragment
+	generation uint32
+	moov       []byte
+}
+
+// one line of index.jsonl
+type archiveEntry struct {
+	Sequence   uint32 `json:"seq"`
+	Pts        uint64 `json:"pts"`
+	Timescale  uint32 `json:"timescale"`
+	Duration   uint64 `json:"duration"`
+	ByteLength uint32 `json:"size"`
+	Keyframe   bool   `json:"keyframe"`
+	IFrameSize uint32 `json:"iframe"`
+	Init       uint32 `json:"init"` // generation of the init segment the fragment refers to
+}
+
+// NewStreamArchive starts an empty archive in dir, sequence numbers of a previous run would clash with the new ones
+func NewStreamArchive(dir string, window uint32) (*StreamArchive, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	index, err := os.OpenFile(filepath.Join(dir, "index.jsonl"), os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	archive := &StreamArchive{
+		dir:     dir,
+		window:  window,
+		pending: map[uint32]chan struct{}{},
+		index:   index,
+		queue:   make(chan archiveJob, ARCHIVE_QUEUE),
+		done:    make(chan struct{}),
+	}
+	go archive.write()
+	return archive, nil
+}
+
+// StoreInit queues the init segment fragments of the given generation refer to
+func (archive *StreamArchive) StoreInit(generation uint32, moov []byte) error {
+	select {
+	case archive.queue <- archiveJob{generation: generation, moov: moov}:
+		return nil
+	default:
+		return ErrArchiveBusy
+	}
+}
+
+// Store queues a complete fragment evicted from the live store, fragments must be stored in sequence order.
+// The archive closes its data once written, on error the data is still the caller's
+func (archive *StreamArchive) Store(frag *Fragment) error {
+	archived := *frag
+	archived.moof, archived.data = nil, nil
+	written := make(chan struct{})
+
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	select {
+	case archive.queue <- archiveJob{frag: frag}:
+	default:
+		return ErrArchiveBusy
+	}
+	archive.fragments = append(archive.fragments, &archived)
+	archive.pending[frag.Sequence] = written
+	return nil
+}
+
+// writes the queued files until the archive is closed
+func (archive *StreamArchive) write() {
+	defer close(archive.done)
+	for job := range archive.queue {
+		if job.frag == nil {
+			if err := os.WriteFile(filepath.Join(archive.dir, fmt.Sprintf("init-%d.mp4", job.generation)), job.moov, 0644); err != nil {
+				mainLog.Error("archiving init segment", "dir", archive.dir, "generation", job.generation, "error", err)
+			}
+			continue
+		}
+		if err := archive.writeFragment(job.frag); err != nil {
+			mainLog.Error("archiving fragment", "dir", archive.dir, "seq", job.frag.Sequence, "error", err)
+		}
+	}
+}
+
+func (archive *StreamArchive) writeFragment(frag *Fragment) error {
+	file, err := os.Create(archive.fragmentPath(frag.Sequence))
+	if err == nil {
+		_, err = io.Copy(file, io.NewSectionReader(frag.data, 0, frag.data.Size()))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(file.Name())
+		}
+	}
+	frag.data.Close()
+
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	close(archive.pending[frag.Sequence])
+	delete(archive.pending, frag.Sequence)
+	if err != nil {
+		// left listed, opening its segment reports it as not archived
+		return err
+	}
+	i := sort.Search(len(archive.fragments), func(i int) bool { return archive.fragments[i].Sequence >= frag.Sequence })
+	if archive.trim(i) {
+		return archive.rewriteIndex()
+	}
+	return archive.appendIndex(archive.fragments[i])
+}
+
+// drops the segments older than the window ending at the fragment at newest (the last one written),
+// keeping the archive starting at a keyframe, returns whether fragments were dropped
+func (archive *StreamArchive) trim(newest int) bool {
+	if archive.window == 0 {
+		return false
+	}
+	end := archive.fragments[newest].Seconds()
+	keep := 0
+	for i, frag := range archive.fragments[:newest+1] {
+		if frag.Keyframe && end-frag.Seconds() <= float64(archive.window) {
+			keep = i
+			break
+		}
+	}
+	if keep == 0 {
+		return false
+	}
+	for _, frag := range archive.fragments[:keep] {
+		os.Remove(archive.fragmentPath(frag.Sequence))
+	}
+	archive.fragments = append([]*Fragment(nil), archive.fragments[keep:]...)
+	return true
+}
+
+func (archive *StreamArchive) appendIndex(frags ...*Fragment) error {
+	encoder := json.NewEncoder(archive.index)
+	for _, frag := range frags {
+		if err := encoder.Encode(archiveEntry{
+			Sequence:   frag.Sequence,
+			Pts:        frag.Pts,
+			Timescale:  frag.Timescale,
+			Duration:   frag.Duration,
+			ByteLength: frag.ByteLength,
+			Keyframe:   frag.Keyframe,
+			IFrameSize: frag.IFrameSize,
+			Init:       frag.generation,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaces index.jsonl with the fragments still archived and already written
+func (archive *StreamArchive) rewriteIndex() error {
+	path := filepath.Join(archive.dir, "index.jsonl")
+	index, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	archive.index.Close()
+	archive.index = index
+	written := archive.fragments
+	for i, frag := range archive.fragments {
+		if _, ok := archive.pending[frag.Sequence]; ok {
+			written = archive.fragments[:i]
+			break
+		}
+	}
+	if err := archive.appendIndex(written...); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Close writes out the queue and releases the index, the archived files are left on disk
+func (archive *StreamArchive) Close() error {
+	close(archive.queue)
+	<-archive.done
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	return archive.index.Close()
+}
+
+// Keyframes lists the archived keyframes older than the given sequence number (the first one still in memory)
+func (archive *StreamArchive) Keyframes(before uint32) []*Fragment {
+	archive.mu.RLock()
+	defer archive.mu.RUnlock()
+	keyframes := []*Fragment{}
+	for _, frag := range archive.fragments {
+		if frag.Sequence >= before {
+			break
+		}
+		if frag.Keyframe {
+			keyframes = append(keyframes, frag)
+		}
+	}
+	return keyframes
+}
+
+// Open returns the archived segment starting at seq along with its open files, to be closed by the caller
+func (archive *StreamArchive) Open(seq uint32) ([]*Fragment, []FragmentData, error) {
+	archive.mu.RLock()
+	i := sort.Search(len(archive.fragments), func(i int) bool { return archive.fragments[i].Sequence >= seq })
+	if i == len(archive.fragments) || archive.fragments[i].Sequence != seq {
+		archive.mu.RUnlock()
+		return nil, nil, ErrNotArchived
+	}
+	if !archive.fragments[i].Keyframe {
+		archive.mu.RUnlock()
+		return nil, nil, ErrNotSegmentStart
+	}
+	// fragments are evicted a segment at a time, the last archived segment is complete as well
+	segment := []*Fragment{archive.fragments[i]}
+	for _, frag := range archive.fragments[i+1:] {
+		if frag.Keyframe {
+			break
+		}
+		segment = append(segment, frag)
+	}
+	pending := []chan struct{}{}
+	for _, frag := range segment {
+		if written, ok := archive.pending[frag.Sequence]; ok {
+			pending = append(pending, written)
+		}
+	}
+	archive.mu.RUnlock()
+
+	// just evicted, still being written
+	for _, written := range pending {
+		<-written
+	}
+	files := make([]FragmentData, 0, len(segment))
+	for _, frag := range segment {
+		file, err := os.Open(archive.fragmentPath(frag.Sequence))
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			if errors.Is(err, os.ErrNotExist) {
+				err = ErrNotArchived // trimmed, or its write failed, meanwhile
+			}
+			return nil, nil, err
+		}
+		files = append(files, fileData{file, int64(frag.ByteLength)})
+	}
+	return segment, files, nil
+}
+
+func (archive *StreamArchive) fragmentPath(seq uint32) string {
+	return filepath.Join(archive.dir, fmt.Sprintf("%d.m4s", seq))
+}
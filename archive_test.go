@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a stream archive holding the first 4 of 6 ingested fragments, a keyframe every 2
+func newTestArchive(t *testing.T, window uint32) *StreamArchive {
+	stream := newTestStream(t, STORE_HEAP)
+	stream.Ingest(bytes.NewReader(testSource(6, 2)))
+	archive, err := NewStreamArchive(filepath.Join(t.TempDir(), "v"), window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.StoreInit(1, stream.moov); err != nil {
+		t.Fatal(err)
+	}
+	for _, frag := range stream.fragments.Evict(4) {
+		if err := archive.Store(frag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return archive
+}
+
+func TestArchiveOpen(t *testing.T) {
+	archive := newTestArchive(t, 0)
+	// listed as soon as queued, opening waits for the files
+	if keyframes := archive.Keyframes(5); len(keyframes) != 2 || keyframes[1].Sequence != 3 {
+		t.Fatalf("archived keyframes %v", keyframes)
+	}
+	for _, seq := range []uint32{1, 3} {
+		segment, files, err := archive.Open(seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content := []byte{}
+		for _, file := range files {
+			b, _ := io.ReadAll(io.NewSectionReader(file, 0, file.Size()))
+			content = append(content, b...)
+			file.Close()
+		}
+		if len(segment) != 2 || !bytes.Equal(content, testSegment(seq)) {
+			t.Errorf("segment %d of %d fragments holds %d bytes, %d ingested", seq, len(segment), len(content), len(testSegment(seq)))
+		}
+	}
+	if _, _, err := archive.Open(2); !errors.Is(err, ErrNotSegmentStart) {
+		t.Errorf("opening fragment 2: %v", err)
+	}
+	if _, _, err := archive.Open(5); !errors.Is(err, ErrNotArchived) {
+		t.Errorf("opening fragment 5: %v", err)
+	}
+
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	index, err := os.ReadFile(filepath.Join(archive.dir, "index.jsonl"))
+	if err != nil || strings.Count(string(index), "\n") != 4 {
+		t.Errorf("index %q, %v", index, err)
+	}
+	if _, err := os.Stat(filepath.Join(archive.dir, "init-1.mp4")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestArchiveWindow(t *testing.T) {
+	archive := newTestArchive(t, 1)
+	archive.Close()
+	// the newest fragment starts at 3s, the segment starting at 2s is the oldest within a second
+	if keyframes := archive.Keyframes(5); len(keyframes) != 1 || keyframes[0].Sequence != 3 {
+		t.Errorf("archived keyframes %v", keyframes)
+	}
+	if _, err := os.Stat(archive.fragmentPath(1)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("fragment 1 left on disk: %v", err)
+	}
+	index, _ := os.ReadFile(filepath.Join(archive.dir, "index.jsonl"))
+	if strings.Count(string(index), "\n") != 2 {
+		t.Errorf("index %q", index)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const JWT_LEEWAY = 30 * time.Second // clock skew tolerated on exp and nbf
+
+// Auth protects manifests, segments and events with signed URLs and JWT bearer tokens, either one is enough
+type Auth struct {
+	Secret   string   // HMAC-SHA256 key of the signed URLs, empty disables them
+	JWKS     string   // JSON Web Key Set file of the JWT signers (HS256, RS256, ES256), empty disables JWT
+	Issuer   string   // iss claim required in the JWT, if set
+	Audience string   // aud claim required in the JWT, if set
+	Origins  []string // CORS origins allowed to read the responses, empty allows any
+	keys     []jwk
+}
+
+var (
+	ErrNoCredentials = errors.New("no signed URL nor bearer token")
+	ErrForbidden     = errors.New("credentials not valid for this request")
+)
+
+// query parameters of the signed URLs, and of the JWT when it cannot be sent as a header (EventSource)
+var authParams = []string{"exp", "prefix", "ip", "sig", "access_token"}
+
+func (auth Auth) enabled() bool {
+	return auth.Secret != "" || auth.JWKS != ""
+}
+
+// protected media may be kept by the player only, a shared cache would serve it to requests without credentials
+func (auth Auth) cacheControl(w http.ResponseWriter, directives string) {
+	if auth.enabled() {
+		w.Header().Set("Cache-Control", "private, "+directives)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, "+directives)
+}
+
+// Protect answers the CORS preflight requests and lets through the requests carrying valid credentials
+func Protect(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := config.Load().Auth
+		auth.allowOrigin(w, r)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Range, If-Range")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if err := auth.Authorize(r); err != nil {
+			httpLog.Debug("request refused", "path", r.URL.Path, "remote", r.RemoteAddr, "error", err)
+			w.Header().Set("Cache-Control", "no-store")
+			if errors.Is(err, ErrNoCredentials) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="ruddr"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// the wildcard when no origin is configured, otherwise the origin of the request when it is allowed
+func (auth Auth) allowOrigin(w http.ResponseWriter, r *http.Request) {
+	if len(auth.Origins) == 0 {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Timing-Allow-Origin", "*")
+		return
+	}
+	w.Header().Add("Vary", "Origin")
+	if origin := r.Header.Get("Origin"); origin != "" && slices.Contains(auth.Origins, origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Timing-Allow-Origin", origin)
+	}
+}
+
+// Authorize checks the signed URL, or else the bearer token (header or access_token parameter) of the request
+func (auth Auth) Authorize(r *http.Request) error {
+	if !auth.enabled() {
+		return nil
+	}
+	query := r.URL.Query()
+	if auth.Secret != "" && query.Has("sig") {
+		return auth.checkSignedURL(r)
+	}
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		token = query.Get("access_token")
+	}
+	if auth.JWKS != "" && token != "" {
+		return auth.checkJWT(token)
+	}
+	return ErrNoCredentials
+}
+
+// authQuery returns the credentials of the request as a query string, for the URIs listed in playlists and MPDs
+// so that players requesting them relative to the manifest keep being authorized
+func authQuery(r *http.Request) string {
+	query := r.URL.Query()
+	credentials := url.Values{}
+	for _, param := range authParams {
+		if query.Has(param) {
+			credentials.Set(param, query.Get(param))
+		}
+	}
+	if len(credentials) == 0 {
+		return ""
+	}
+	return "?" + credentials.Encode()
+}
+
+// Sign returns the query authorizing the paths starting with prefix until exp, from the ip address only when not empty
+func (auth Auth) Sign(prefix string, exp time.Time, ip string) url.Values {
+	expiry := strconv.FormatInt(exp.Unix(), 10)
+	query := url.Values{}
+	query.Set("exp", expiry)
+	query.Set("prefix", prefix)
+	if ip != "" {
+		query.Set("ip", ip)
+	}
+	query.Set("sig", auth.signature(prefix, expiry, ip))
+	return query
+}
+
+func (auth Auth) signature(prefix, expiry, ip string) string {
+	mac := hmac.New(sha256.New, []byte(auth.Secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s", prefix, expiry, ip)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// without prefix the signature covers the path of the request only
+func (auth Auth) checkSignedURL(r *http.Request) error {
+	query := r.URL.Query()
+	prefix, expiry, ip := r.URL.Path, query.Get("exp"), query.Get("ip")
+	if query.Has("prefix") {
+		prefix = query.Get("prefix")
+	}
+	if !hmac.Equal([]byte(query.Get("sig")), []byte(auth.signature(prefix, expiry, ip))) {
+		return fmt.Errorf("%w: bad signature", ErrForbidden)
+	}
+	exp, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return fmt.Errorf("%w: signed URL expired", ErrForbidden)
+	}
+	// on a path segment boundary, /mux/a does not cover /mux/ab
+	if r.URL.Path != prefix && !strings.HasPrefix(r.URL.Path, strings.TrimSuffix(prefix, "/")+"/") {
+		return fmt.Errorf("%w: path outside of %s", ErrForbidden, prefix)
+	}
+	if ip != "" && ip != clientIP(r) {
+		return fmt.Errorf("%w: signed for another client", ErrForbidden)
+	}
+	return nil
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// jwk is a verification key of the key set, the public part only for RSA and EC
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	K   string `json:"k"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	key any    // []byte, *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+// reads the key set file, keys of unsupported types are an error rather than being silently skipped
+func (auth *Auth) loadKeys() error {
+	auth.keys = nil
+	if auth.JWKS == "" {
+		return nil
+	}
+	data, err := os.ReadFile(auth.JWKS)
+	if err != nil {
+		return err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("%s: %w", auth.JWKS, err)
+	}
+	for i := range set.Keys {
+		if err := set.Keys[i].parse(); err != nil {
+			return fmt.Errorf("%s: key %d (%s): %w", auth.JWKS, i, set.Keys[i].Kid, err)
+		}
+	}
+	if len(set.Keys) == 0 {
+		return fmt.Errorf("%s: no keys", auth.JWKS)
+	}
+	auth.keys = set.Keys
+	return nil
+}
+
+func (key *jwk) parse() error {
+	decode := base64.RawURLEncoding.DecodeString
+	switch key.Kty {
+	case "oct":
+		k, err := decode(key.K)
+		if err != nil || len(k) == 0 {
+			return errors.New("invalid k")
+		}
+		key.key = k
+	case "RSA":
+		n, errN := decode(key.N)
+		e, errE := decode(key.E)
+		if errN != nil || errE != nil || len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return errors.New("invalid or shorter than 2048 bits modulus or exponent")
+		}
+		key.key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case "EC":
+		if key.Crv != "P-256" {
+			return fmt.Errorf("unsupported curve %q", key.Crv)
+		}
+		x, errX := decode(key.X)
+		y, errY := decode(key.Y)
+		if errX != nil || errY != nil {
+			return errors.New("invalid coordinates")
+		}
+		public := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !public.Curve.IsOnCurve(public.X, public.Y) {
+			return errors.New("point not on the curve")
+		}
+		key.key = public
+	default:
+		return fmt.Errorf("unsupported key type %q", key.Kty)
+	}
+	return nil
+}
+
+// key type each algorithm is verified with, so that a public key is never used as an HMAC secret
+var jwtKeyTypes = map[string]string{"HS256": "oct", "RS256": "RSA", "ES256": "EC"}
+
+func (auth Auth) checkJWT(token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("%w: malformed token", ErrForbidden)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return fmt.Errorf("%w: header: %s", ErrForbidden, err)
+	}
+	kty, ok := jwtKeyTypes[header.Alg]
+	if !ok {
+		return fmt.Errorf("%w: unsupported alg %q", ErrForbidden, header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("%w: signature: %s", ErrForbidden, err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	verified := false
+	for _, key := range auth.keys {
+		if key.Kty != kty || (header.Kid != "" && key.Kid != header.Kid) || (key.Alg != "" && key.Alg != header.Alg) {
+			continue
+		}
+		if verified = verify(key, parts[0]+"."+parts[1], digest[:], signature); verified {
+			break
+		}
+	}
+	if !verified {
+		return fmt.Errorf("%w: bad signature", ErrForbidden)
+	}
+
+	var claims struct {
+		Exp *float64        `json:"exp"`
+		Nbf *float64        `json:"nbf"`
+		Iss string          `json:"iss"`
+		Aud json.RawMessage `json:"aud"` // a string or an array of strings
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return fmt.Errorf("%w: claims: %s", ErrForbidden, err)
+	}
+	now := time.Now()
+	// a token without expiry would be valid forever
+	if claims.Exp == nil {
+		return fmt.Errorf("%w: token without exp", ErrForbidden)
+	}
+	if now.Add(-JWT_LEEWAY).After(time.Unix(int64(*claims.Exp), 0)) {
+		return fmt.Errorf("%w: token expired", ErrForbidden)
+	}
+	if claims.Nbf != nil && now.Add(JWT_LEEWAY).Before(time.Unix(int64(*claims.Nbf), 0)) {
+		return fmt.Errorf("%w: token not valid yet", ErrForbidden)
+	}
+	if auth.Issuer != "" && claims.Iss != auth.Issuer {
+		return fmt.Errorf("%w: issuer %q", ErrForbidden, claims.Iss)
+	}
+	if auth.Audience != "" && !hasAudience(claims.Aud, auth.Audience) {
+		return fmt.Errorf("%w: audience not accepted", ErrForbidden)
+	}
+	return nil
+}
+
+func verify(key jwk, signed string, digest, signature []byte) bool {
+	switch public := key.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, public)
+		mac.Write([]byte(signed))
+		return hmac.Equal(mac.Sum(nil), signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(public, crypto.SHA256, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		// r and s concatenated, 32 bytes each
+		if len(signature) != 64 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(public, digest, r, s)
+	}
+	return false
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func hasAudience(aud json.RawMessage, audience string) bool {
+	var one string
+	if json.Unmarshal(aud, &one) == nil {
+		return one == audience
+	}
+	var many []string
+	return json.Unmarshal(aud, &many) == nil && slices.Contains(many, audience)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSignedURLPrefix(t *testing.T) {
+	auth := Auth{Secret: "secret"}
+	query := auth.Sign("/mux/a", time.Now().Add(time.Hour), "").Encode()
+	for path, allowed := range map[string]bool{
+		"/mux/a":            true,
+		"/mux/a/":           true,
+		"/mux/a/v/init.mp4": true,
+		"/mux/ab":           false,
+		"/mux/ab/v/1":       false,
+		"/mux":              false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, path+"?"+query, nil)
+		if err := auth.Authorize(r); (err == nil) != allowed {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+	// a prefix ending with a slash covers the same paths
+	query = auth.Sign("/mux/a/", time.Now().Add(time.Hour), "").Encode()
+	if err := auth.Authorize(httptest.NewRequest(http.MethodGet, "/mux/ab?"+query, nil)); err == nil {
+		t.Error("/mux/ab authorized by /mux/a/")
+	}
+}
+
+// an HS256 token of the given claims
+func testJWT(key []byte, claims map[string]any) string {
+	encode := func(v any) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := encode(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + encode(claims)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTExpiry(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	auth := Auth{JWKS: "keys.json", keys: []jwk{{Kty: "oct", key: key}}}
+	for name, test := range map[string]struct {
+		claims  map[string]any
+		allowed bool
+	}{
+		"valid":       {map[string]any{"exp": time.Now().Add(time.Hour).Unix()}, true},
+		"expired":     {map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}, false},
+		"without exp": {map[string]any{"sub": "player"}, false},
+	} {
+		err := auth.checkJWT(testJWT(key, test.claims))
+		if (err == nil) != test.allowed || (err != nil && !errors.Is(err, ErrForbidden)) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestProtectIngest(t *testing.T) {
+	previous := config.Load()
+	t.Cleanup(func() { config.Store(previous) })
+	next := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	ingest := func(remote, token string) int {
+		r := httptest.NewRequest(http.MethodPut, "/mux/ingest/v", nil)
+		r.RemoteAddr = remote
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		ProtectIngest(next)(w, r)
+		return w.Code
+	}
+
+	// without any token, local encoders only
+	config.Store(&Config{})
+	if code := ingest("127.0.0.1:4000", ""); code != http.StatusNoContent {
+		t.Errorf("local ingest answered %d", code)
+	}
+	if code := ingest("192.0.2.1:4000", ""); code != http.StatusForbidden {
+		t.Errorf("remote ingest answered %d", code)
+	}
+
+	config.Store(&Config{Server: Server{AdminToken: "admin", IngestToken: "ingest"}})
+	for token, want := range map[string]int{"ingest": http.StatusNoContent, "admin": http.StatusUnauthorized, "": http.StatusUnauthorized} {
+		if code := ingest("192.0.2.1:4000", token); code != want {
+			t.Errorf("token %q answered %d", token, code)
+		}
+	}
+	if code := ingest("127.0.0.1:4000", ""); code != http.StatusUnauthorized {
+		t.Errorf("local ingest without the token answered %d", code)
+	}
+
+	// the admin token when there is no dedicated one
+	config.Store(&Config{Server: Server{AdminToken: "admin"}})
+	if code := ingest("192.0.2.1:4000", "admin"); code != http.StatusNoContent {
+		t.Errorf("admin token answered %d", code)
+	}
+}
+
+func TestProtectedCacheControl(t *testing.T) {
+	previous := config.Load()
+	t.Cleanup(func() { config.Store(previous) })
+	_, server := newTestServer(t, STORE_HEAP, false)
+	for _, test := range []struct {
+		auth                  Auth
+		segment, init, latest string
+	}{
+		{Auth{}, "public, max-age=180", "public, max-age=180", "public, no-cache"},
+		{Auth{Secret: "secret"}, "private, max-age=180", "private, max-age=180", "private, no-cache"},
+		{Auth{JWKS: "keys.json"}, "private, max-age=180", "private, max-age=180", "private, no-cache"},
+	} {
+		config.Store(&Config{Auth: test.auth})
+		for path, expected := range map[string]string{"3": test.segment, "part/3": test.segment, "init-1.mp4": test.init, "init.mp4": test.latest} {
+			response, err := http.Get(server.URL + "/test/v/" + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			if cacheControl := response.Header.Get("Cache-Control"); response.StatusCode != http.StatusOK || cacheControl != expected {
+				t.Errorf("auth %v, %s: status %d, Cache-Control %q, expected %q", test.auth.enabled(), path, response.StatusCode, cacheControl, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Channel is an independent live event: its own ladder, ingester parameters, forecast and manifests under {Root}/{Name}
+type Channel struct {
+	Representations map[string]*Representation
+	Ingester        Ingester     // zero fields take the value of the top level [Ingester]
+	Name            string       `toml:"-"`
+	Root            string       `toml:"-"` // path prefix of every handler of the channel
+	mu              sync.RWMutex // guards Representations and streams, changed by the admin API
+	streams         []*InputStream
+	handlers        sync.Map // representation id -> http.HandlerFunc
+	events          chan Event
+	broadcaster     *Broadcaster
+	forecast        sync.Map     // window key -> representation id -> fragments
+	cmcd            CmcdSessions // players reporting CMCD on the manifests, segments and events
+	wg              *sync.WaitGroup
+	live            atomic.Pointer[Ingester] // Ingester once started, replaced on reload
+}
+
+const SSE_QUEUE = 16 // events waiting for the broadcaster, the ingest drops its own when full
+
+// paths under {Root} that cannot be used as channel names
+var reservedChannelNames = []string{"ingest", "events", "manifest.mpd", "master.m3u8", "admin"}
+
+// the configured channels, or a single one under {Root} made of the top level representations
+func (config Config) channelList() ([]*Channel, error) {
+	if len(config.Channels) == 0 {
+		return []*Channel{{
+			Representations: config.Representations,
+			Ingester:        config.Ingester,
+			Root:            config.Server.Root,
+		}}, nil
+	}
+	if len(config.Representations) > 0 {
+		return nil, fmt.Errorf("representations must be declared inside [Channels.<name>] when channels are configured")
+	}
+	list := []*Channel{}
+	for name, channel := range config.Channels {
+		if name == "" || strings.ContainsAny(name, "/?#%") {
+			return nil, fmt.Errorf("invalid channel name %q", name)
+		}
+		for _, reserved := range reservedChannelNames {
+			if name == reserved {
+				return nil, fmt.Errorf("channel name %q is reserved", name)
+			}
+		}
+		channel.Name = name
+		channel.Root = config.Server.Root + "/" + name
+		channel.Ingester = channel.Ingester.withDefaults(config.Ingester)
+		list = append(list, channel)
+	}
+	return list, nil
+}
+
+// ingester parameters in use, to be read instead of Ingester once the channel is started
+func (channel *Channel) ingester() *Ingester {
+	return channel.live.Load()
+}
+
+func (ingester Ingester) withDefaults(defaults Ingester) Ingester {
+	if ingester.HeapSize == 0 {
+		ingester.HeapSize = defaults.HeapSize
+	}
+	if ingester.FragmentDuration == 0 {
+		ingester.FragmentDuration = defaults.FragmentDuration
+	}
+	if ingester.ControllerFrequency == 0 {
+		ingester.ControllerFrequency = defaults.ControllerFrequency
+	}
+	if ingester.Horizon == 0 {
+		ingester.Horizon = defaults.Horizon
+	}
+	if ingester.Store == "" {
+		ingester.Store = defaults.Store
+	}
+	if ingester.StoreDirectory == "" {
+		ingester.StoreDirectory = defaults.StoreDirectory
+	}
+	return ingester
+}
+
+// Start creates the streams of the channel and registers its handlers on mux, wg is done when the pipes are not read anymore
+func (channel *Channel) Start(wg *sync.WaitGroup, mux *http.ServeMux) error {
+	channel.wg = wg
+	ingester := channel.Ingester
+	channel.live.Store(&ingester)
+	channel.events = make(chan Event, SSE_QUEUE)
+	sseLog := config.Load().Log.ComponentLogger("sse")
+	if channel.Name != "" {
+		sseLog = sseLog.With("channel", channel.Name)
+	}
+	channel.broadcaster = NewBroadcaster(channel.events, sseLog)
+	if err := channel.broadcaster.Start(); err != nil {
+		return fmt.Errorf("starting broadcaster: %w", err)
+	}
+
+	for streamId, repr := range channel.Representations {
+		repr.Id = streamId
+		stream, err := channel.newStream(repr)
+		if err != nil {
+			return err
+		}
+		channel.streams = append(channel.streams, stream)
+		channel.run(stream)
+	}
+
+	mux.HandleFunc(channel.Root+"/events", Protect(channel.collectCmcd(channel.broadcaster.HandlerFunc())))
+	mux.HandleFunc(channel.Root+"/ingest/", ProtectIngest(channel.IngestHandler))
+	mux.HandleFunc(channel.Root+"/manifest.mpd", Protect(channel.collectCmcd(channel.DashHandler)))
+	mux.HandleFunc(channel.Root+"/master.m3u8", Protect(channel.collectCmcd(channel.MultivariantHandler)))
+	mux.HandleFunc(channel.Root+"/", Protect(channel.collectCmcd(channel.route))) // JSON manifest and representations
+	return nil
+}
+
+// registers the HTTP handler of the stream and starts feeding its forecast, and reading its pipe if any
+func (channel *Channel) run(stream *InputStream) {
+	stream.Serve()
+	go channel.publishForecast(stream)
+	if stream.repr.Pipe != "" {
+		channel.supervise(stream)
+	}
+}
+
+// (re)starts the pipe supervisor of the stream, the caller holds channel.mu when the stream is running
+func (channel *Channel) supervise(stream *InputStream) {
+	ctx, cancel := context.WithCancel(stream.ctx)
+	stream.stopPipe = cancel
+	channel.wg.Add(1)
+	go func(pipe string) {
+		defer channel.wg.Done()
+		stream.Supervise(ctx, pipe) // reopens the pipe whenever the writer goes away
+	}(stream.repr.Pipe)
+}
+
+// route serves {Root}/{id}/... with the representation handler, and the JSON manifest otherwise
+func (channel *Channel) route(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, channel.Root+"/")
+	id, _, found := strings.Cut(rest, "/")
+	if !found {
+		channel.ManifestHandler(w, r)
+		return
+	}
+	handler, ok := channel.handlers.Load(id)
+	if !ok {
+		// never configured, or removed through the admin API
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Representation %s not found", id)
+		return
+	}
+	handler.(http.HandlerFunc)(w, r)
+}
+
+func (channel *Channel) handle(id string, handler http.HandlerFunc) {
+	channel.handlers.Store(id, handler)
+}
+
+// Streams returns the representations currently running
+func (channel *Channel) Streams() []*InputStream {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	return append([]*InputStream(nil), channel.streams...)
+}
+
+func (channel *Channel) stream(id string) *InputStream {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	for _, stream := range channel.streams {
+		if stream.repr.Id == id {
+			return stream
+		}
+	}
+	return nil
+}
+
+func (channel *Channel) representations() map[string]*Representation {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	representations := make(map[string]*Representation, len(channel.Representations))
+	for id, repr := range channel.Representations {
+		representations[id] = repr
+	}
+	return representations
+}
+
+// representations whose fragments are expected for the forecast, the ones stalled or not started are not waited for
+func (channel *Channel) liveCount() int {
+	now := time.Now()
+	count := 0
+	for _, stream := range channel.Streams() {
+		if stream.Health(now).Ready {
+			count++
+		}
+	}
+	return count
+}
+
+// AddRepresentation starts a new representation, or reconfigures the pipe and the log level of an existing one
+// returns true when the representation was created
+func (channel *Channel) AddRepresentation(id string, update Representation) (*InputStream, bool, error) {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+	for _, stream := range channel.streams {
+		if stream.repr.Id != id {
+			continue
+		}
+		stream.repr.Log, stream.repr.LogLevel = update.Log, update.LogLevel
+		stream.logLevel.Set(config.Load().Log.StreamLevel(stream.repr))
+		if update.Pipe != stream.repr.Pipe {
+			if stream.stopPipe != nil {
+				stream.stopPipe()
+				stream.stopPipe = nil
+			}
+			stream.repr.Pipe = update.Pipe
+			if update.Pipe != "" {
+				channel.supervise(stream)
+			}
+		}
+		return stream, false, nil
+	}
+
+	repr := &Representation{Id: id, Pipe: update.Pipe, Log: update.Log, LogLevel: update.LogLevel}
+	stream, err := channel.newStream(repr)
+	if err != nil {
+		return nil, false, err
+	}
+	if channel.Representations == nil {
+		channel.Representations = map[string]*Representation{}
+	}
+	channel.Representations[id] = repr
+	channel.streams = append(channel.streams, stream)
+	channel.run(stream)
+	return stream, true, nil
+}
+
+// RemoveRepresentation stops a representation and drops it from the manifests, false when it does not exist
+func (channel *Channel) RemoveRepresentation(id string) bool {
+	channel.mu.Lock()
+	var stream *InputStream
+	for i, s := range channel.streams {
+		if s.repr.Id == id {
+			stream = s
+			channel.streams = append(channel.streams[:i:i], channel.streams[i+1:]...)
+			break
+		}
+	}
+	delete(channel.Representations, id)
+	channel.handlers.Delete(id)
+	channel.mu.Unlock()
+
+	if stream == nil {
+		return false
+	}
+	stream.Stop()
+	mainLog.Info("representation removed", "channel", channel.Name, "representation", id)
+	return true
+}
+
+func (channel *Channel) newStream(repr *Representation) (*InputStream, error) {
+	// representations without a pipe are fed only through the HTTP ingest endpoint
+	if repr.Pipe != "" {
+		mainLog.Info("representation", "channel", channel.Name, "representation", repr.Id, "pipe", repr.Pipe)
+	} else {
+		mainLog.Info("representation", "channel", channel.Name, "representation", repr.Id, "ingest", channel.Root+"/ingest/"+repr.Id)
+	}
+
+	store, err := NewFragmentStore(channel.ingester().Store, channel.ingester().StoreDirectory)
+	if err != nil {
+		return nil, fmt.Errorf("creating fragment store of representation %s: %w", repr.Id, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &InputStream{
+		ctx:             ctx,
+		cancel:          cancel,
+		repr:            repr,
+		channel:         channel,
+		fragments:       store,
+		fragmentsWindow: NewCircularBuffer[Fragment](channel.ingester().Horizon), // items (windows) are indexed by pts
+		events:          channel.events,
+	}
+	settings := config.Load()
+	stream.logLevel.Set(settings.Log.StreamLevel(repr))
+	stream.log = settings.Log.StreamLogger(channel.Name, repr, &stream.logLevel)
+	if settings.Archive.Directory != "" {
+		archive, err := NewStreamArchive(filepath.Join(settings.Archive.Directory, channel.Name, repr.Id), settings.Archive.Window)
+		if err != nil {
+			return nil, fmt.Errorf("creating archive of representation %s: %w", repr.Id, err)
+		}
+		stream.archive = archive
+	}
+	return stream, nil
+}
+
+// groups the window updates of the representations and sends them to the SSE clients once all of them are in
+func (channel *Channel) publishForecast(stream *InputStream) {
+	toSend := 0 // keep track of how many to send still via SSE
+	for {
+		var update []*Fragment
+		select {
+		case <-stream.ctx.Done():
+			return
+		case update = <-stream.fragmentsWindow.Updates():
+		}
+		// audio fragments do not end exactly where video ones do, windows are matched on the fragment grid
+		latest := update[len(update)-1] // the fragment that triggered the update, the window may have moved on since
+		key := channel.windowKey(latest)
+		window, _ := channel.forecast.LoadOrStore(key, &sync.Map{})
+		window.(*sync.Map).Store(stream.repr.Id, update)
+
+		if w, ok := channel.forecast.Load(key); ok {
+			// IMPR: len for sync.Maps is not available
+			regularMap, count := ConvertSyncMapToMap[[]*Fragment](w.(*sync.Map))
+
+			// group all representation per update
+			if count < channel.liveCount() {
+				continue
+			}
+			// fmt.Println(stream.sizesWindow.latest.Pts, "Common")
+			// lastCommonPts = float32(stream.fragmentsWindow.latest.Pts)
+			// lastCommonSeq = uint32(stream.fragmentsWindow.latest.Sequence)
+
+			if data, err := json.Marshal(struct {
+				Pts       uint64       `json:"pts"`
+				Timescale uint32       `json:"timescale"`
+				Seq       uint32       `json:"seq"`
+				Window    Forecast     `json:"window"`
+				Clients   *CmcdSummary `json:"clients,omitempty"` // what the players report, for the controller to weigh the forecast
+			}{
+				Pts:       latest.Pts,
+				Timescale: latest.Timescale,
+				Seq:       latest.Sequence,
+				Window:    regularMap,
+				Clients:   channel.cmcd.Summary(),
+			}); err == nil {
+				toSend++
+				// a reload may lower the frequency below the updates already counted
+				if toSend >= channel.ingester().ControllerFrequency {
+					channel.events <- Event{Data: data}
+					toSend = 0
+				}
+			}
+		}
+
+	}
+}
+
+// ManifestHandler writes the JSON manifest of the channel: timeline, representations and keyframes
+func (channel *Channel) ManifestHandler(w http.ResponseWriter, r *http.Request) {
+	common_start_time, lastSeqNumber := channel.commonTimeline()
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+	w.Header().Set("Expires", "0")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Expose-Headers", "ruddr-time")
+	w.Header().Set("Ruddr-Time", fmt.Sprintf("%d", time.Now().UnixMilli()))
+
+	keyframes := make(map[string][]*Fragment)
+	discontinuities := make(map[string][]uint32)
+	for _, stream := range channel.Streams() {
+		keyframes[stream.repr.Id] = stream.DvrKeyframes()
+		discontinuities[stream.repr.Id] = stream.discontinuities
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(Manifest{
+		Config:          *channel.ingester(),
+		Start:           common_start_time,
+		Head:            lastSeqNumber,
+		Epoch:           uint64(common_start_time.UnixMilli()),
+		Representations: channel.representations(),
+		Keyframes:       keyframes,
+		Discontinuities: discontinuities,
+	})
+}
+
+// index of the nominal fragment slot the fragment falls into, rounded to the nearest one in integer arithmetic
+func (channel *Channel) windowKey(frag *Fragment) uint64 {
+	slot := uint64(frag.Timescale) * uint64(channel.ingester().FragmentDuration) // fragment duration in timescale units * 1000
+	return (frag.Pts*1000 + slot/2) / slot
+}
+
+// start time and head sequence number shared by all the representations
+func (channel *Channel) commonTimeline() (time.Time, uint32) {
+	streams := channel.Streams()
+	if len(streams) == 0 {
+		return time.Time{}, 0
+	}
+	common_start_time := streams[0].timestamp
+	lastSeqNumber := streams[0].lastSeqNumber.Load()
+
+	for _, stream := range streams {
+		// gli stream _possono_ essere inizializzati in tempi diversi (primo moov atom)
+		if stream.timestamp.After(common_start_time) {
+			common_start_time = stream.timestamp
+		}
+		// gli stream _dovrebbero_ avere in sincronia lo stesso numero di sequenza
+		if seq := stream.lastSeqNumber.Load(); seq < lastSeqNumber {
+			lastSeqNumber = seq
+			mainLog.Debug("sequence number mismatch, gathering lowest", "channel", channel.Name, "representation", stream.repr.Id, "seq", seq)
+		}
+	}
+	return common_start_time, lastSeqNumber
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// starts the channels of the configuration on their own mux, as main does
+func newTestChannels(t *testing.T, settings *Config) *httptest.Server {
+	t.Helper()
+	previousConfig, previousChannels := config.Load(), channels
+	t.Cleanup(func() {
+		config.Store(previousConfig)
+		channels = previousChannels
+	})
+	settings.Ingester = Ingester{FragmentDuration: 1000, Horizon: 4, ControllerFrequency: 1, HeapSize: 10, Store: STORE_HEAP, StoreDirectory: t.TempDir()}
+	config.Store(settings)
+	list, err := settings.channelList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	mux := http.NewServeMux()
+	channels = nil
+	for _, channel := range list {
+		if err := channel.Start(&wg, mux); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			channel.broadcaster.Stop()
+			for _, stream := range channel.Streams() {
+				stream.Stop()
+			}
+		})
+		channels = append(channels, channel)
+	}
+	mux.HandleFunc(settings.Server.Root+"/admin/", AdminHandler)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestChannelRouting(t *testing.T) {
+	server := newTestChannels(t, &Config{
+		Server: Server{Root: "/live"},
+		Channels: map[string]*Channel{
+			"a": {Representations: map[string]*Representation{"v": {}}},
+			"b": {Representations: map[string]*Representation{"v": {}, "audio": {}}},
+		},
+	})
+	get := func(path string) (int, []byte) {
+		t.Helper()
+		response, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return response.StatusCode, body
+	}
+	for path, source := range map[string][]byte{"/live/a/ingest/v": testSource(6, 2), "/live/b/ingest/v": testSource(4, 2)} {
+		response, err := http.Post(server.URL+path, "video/mp4", bytes.NewReader(source))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusNoContent {
+			t.Errorf("%s: status %d", path, response.StatusCode)
+		}
+	}
+
+	// the same representation id in two channels, each with its own fragments
+	if status, body := get("/live/a/v/3"); status != http.StatusOK || !bytes.Equal(body, testSegment(3)) {
+		t.Errorf("segment 3 of a: status %d, %d bytes", status, len(body))
+	}
+	if status, _ := get("/live/b/v/3"); status != http.StatusNotFound {
+		t.Errorf("segment 3 of b, only 4 fragments ingested: status %d", status)
+	}
+	if status, body := get("/live/b/v/1"); status != http.StatusOK || !bytes.Equal(body, testSegment(1)) {
+		t.Errorf("segment 1 of b: status %d, %d bytes", status, len(body))
+	}
+	if status, _ := get("/live/b/audio/init.mp4"); status != http.StatusNotAcceptable {
+		t.Errorf("init of a representation not ingested yet: status %d", status)
+	}
+
+	for path, expected := range map[string][]string{"/live/a/": {"v"}, "/live/b/": {"audio", "v"}} {
+		status, body := get(path)
+		var manifest struct {
+			Representations map[string]*Representation
+		}
+		if err := json.Unmarshal(body, &manifest); err != nil || status != http.StatusOK {
+			t.Fatalf("%s: status %d, %v", path, status, err)
+		}
+		if len(manifest.Representations) != len(expected) {
+			t.Errorf("%s: representations %v, expected %v", path, manifest.Representations, expected)
+		}
+		for _, id := range expected {
+			if manifest.Representations[id] == nil {
+				t.Errorf("%s: representation %s missing", path, id)
+			}
+		}
+	}
+	for _, path := range []string{"/live/c/v/1", "/live/a/audio/1", "/live/v/1"} {
+		if status, _ := get(path); status != http.StatusNotFound {
+			t.Errorf("%s: status %d", path, status)
+		}
+	}
+}
+
+func TestChannelNames(t *testing.T) {
+	for _, name := range []string{"admin", "ingest", "a/b", ""} {
+		settings := Config{Channels: map[string]*Channel{name: {}}}
+		if _, err := settings.channelList(); err == nil {
+			t.Errorf("channel %q accepted", name)
+		}
+	}
+	settings := Config{Representations: map[string]*Representation{"v": {}}, Channels: map[string]*Channel{"a": {}}}
+	if _, err := settings.channelList(); err == nil {
+		t.Error("top level representations accepted along with channels")
+	}
+}
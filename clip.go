@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+const (
+	CLIP_FMP4 = "fmp4" // init segment, the fragments as they were received and an mfra index
+	CLIP_MP4  = "mp4"  // progressive file, a single mdat described by a rebuilt sample table
+)
+
+var (
+	ErrClipNotInWindow   = errors.New("clip not in the live window")
+	ErrClipDiscontinuity = errors.New("clip spans a discontinuity")
+)
+
+// ServeClip exports the keyframe aligned fragments between ?from= and ?to= (stream timescale) as a downloadable file
+func (stream *InputStream) ServeClip(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, errFrom := strconv.ParseUint(query.Get("from"), 10, 64)
+	to, errTo := strconv.ParseUint(query.Get("to"), 10, 64)
+	format := query.Get("format")
+	if format == "" {
+		format = CLIP_FMP4
+	}
+	if errFrom != nil || errTo != nil || from >= to || (format != CLIP_FMP4 && format != CLIP_MP4) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Expected ?from=<pts>&to=<pts>[&format=fmp4|mp4] with from < to")
+		return
+	}
+
+	clip, err := stream.clipFragments(from, to)
+	if errors.Is(err, ErrClipNotInWindow) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Clip %d-%d not found", from, to)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Clip %d-%d not available: %s", from, to, err)
+		return
+	}
+
+	var header, trailer []byte
+	var data []*io.SectionReader // parts of the fragments, in the order they are written
+	if format == CLIP_MP4 {
+		header, data, err = stream.progressiveClip(clip)
+	} else {
+		header, trailer, data, err = stream.fragmentedClip(clip)
+	}
+	if err != nil {
+		stream.log.Error("building clip", "from", from, "to", to, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	size := int64(len(header) + len(trailer))
+	readers := []io.Reader{bytes.NewReader(header)}
+	for _, section := range data {
+		size += section.Size()
+		readers = append(readers, section)
+	}
+	readers = append(readers, bytes.NewReader(trailer))
+	w.Header().Set("Content-Type", stream.repr.Type+"/mp4")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-%d-%d.mp4\"", stream.repr.Id, from, to))
+	w.WriteHeader(http.StatusOK)
+
+	// fragments evicted meanwhile fail to read and truncate the download, the client sees a short body
+	if _, err := io.Copy(w, io.MultiReader(readers...)); err != nil {
+		stream.log.Warn("writing clip", "from", from, "to", to, "error", err)
+	}
+}
+
+// from the keyframe at or before from, up to the keyframe at or after to (excluded) or the last complete fragment
+func (stream *InputStream) clipFragments(from, to uint64) ([]*Fragment, error) {
+	clip := []*Fragment{}
+	stream.fragments.Range(func(frag *Fragment) bool {
+		pts := Rescale(frag.Pts, frag.Timescale, stream.timescale)
+		if frag.data == nil {
+			return false // still being produced
+		}
+		if frag.Keyframe {
+			if pts >= to {
+				return false
+			}
+			if pts <= from {
+				clip = clip[:0] // a later keyframe still before from
+			}
+		}
+		if len(clip) > 0 || frag.Keyframe {
+			clip = append(clip, frag)
+		}
+		return true
+	})
+	if len(clip) == 0 || Rescale(clip[len(clip)-1].Pts+clip[len(clip)-1].Duration, clip[len(clip)-1].Timescale, stream.timescale) <= from {
+		return nil, ErrClipNotInWindow
+	}
+
+	for i, frag := range clip {
+		if frag.generation != stream.generation {
+			return nil, ErrClipDiscontinuity // the init segment it refers to is gone
+		}
+		if i > 0 && frag.Sequence != clip[i-1].Sequence+1 {
+			return nil, ErrClipNotInWindow
+		}
+		for _, seq := range stream.discontinuities {
+			if i > 0 && seq == frag.Sequence {
+				return nil, ErrClipDiscontinuity
+			}
+		}
+	}
+	return clip, nil
+}
+
+// ftyp + moov, the fragments untouched, mfra pointing at each keyframe moof
+func (stream *InputStream) fragmentedClip(clip []*Fragment) ([]byte, []byte, []*io.SectionReader, error) {
+	header := append(makeBox("ftyp", []byte("iso6"), u32(0), []byte("iso6cmfcmp41")), stream.moov...)
+
+	trackId := uint32(1)
+	entries := []byte{}
+	count := uint32(0)
+	offset := uint64(len(header))
+	data := make([]*io.SectionReader, 0, len(clip))
+	for _, frag := range clip {
+		p := NewMP4Parser(stream.moov, frag.moof)
+		if frag.Keyframe {
+			decodeTime, err := p.GetDecodeTime()
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if trackId, err = p.GetTrackID(); err != nil {
+				return nil, nil, nil, err
+			}
+			// version 1: 64 bit time and moof_offset, 8 bit traf/trun/sample numbers
+			entries = append(entries, u64(decodeTime)...)
+			entries = append(entries, u64(offset)...)
+			entries = append(entries, 1, 1, 1)
+			count++
+		}
+		data = append(data, io.NewSectionReader(frag.data, 0, frag.data.Size()))
+		offset += uint64(frag.data.Size())
+	}
+
+	tfra := makeFullBox("tfra", 1, 0, u32(trackId), u32(0), u32(count), entries)
+	mfro := makeFullBox("mfro", 0, 0, u32(uint32(8+len(tfra)+16)))
+	return header, makeBox("mfra", tfra, mfro), data, nil
+}
+
+// ftyp + moov with a sample table describing the samples of every fragment, then a single mdat
+func (stream *InputStream) progressiveClip(clip []*Fragment) ([]byte, []*io.SectionReader, error) {
+	table := sampleTable{}
+	data := []*io.SectionReader{}
+	mdatSize := uint64(0)
+	for _, frag := range clip {
+		runs, err := NewMP4Parser(stream.moov, frag.moof).GetTrackRuns()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, run := range runs {
+			size := int64(0)
+			for _, sample := range run.Samples {
+				size += int64(sample.Size)
+			}
+			if len(run.Samples) == 0 {
+				continue
+			}
+			if run.DataOffset+uint64(size) > uint64(frag.data.Size()) {
+				return nil, nil, &BoxError{Type: "trun", Err: ErrBoxTruncated}
+			}
+			// every run becomes a chunk, placed right after the previous one
+			table.addChunk(mdatSize, run.Samples)
+			data = append(data, io.NewSectionReader(frag.data, int64(run.DataOffset), size))
+			mdatSize += uint64(size)
+		}
+	}
+
+	ftyp := makeBox("ftyp", []byte("isom"), u32(0x200), []byte("isomiso2mp41"))
+	largeMdat := mdatSize+8 > 0xFFFFFFFF
+	mdatHeader := makeBoxHeader("mdat", mdatSize, largeMdat)
+
+	// the chunk offsets depend on the size of the moov itself, which does not depend on their values
+	moov, err := table.rebuildMoov(stream.moov, stream.timescale, 0, largeMdat)
+	if err != nil {
+		return nil, nil, err
+	}
+	base := uint64(len(ftyp)+len(moov)) + uint64(len(mdatHeader))
+	if moov, err = table.rebuildMoov(stream.moov, stream.timescale, base, largeMdat); err != nil {
+		return nil, nil, err
+	}
+
+	header := append(append(ftyp, moov...), mdatHeader...)
+	return header, data, nil
+}
+
+// sampleTable collects the samples of a progressive file, one chunk per track run
+type sampleTable struct {
+	durations    []uint32
+	sizes        []uint32
+	offsets      []int32 // composition offsets
+	sync         []uint32
+	chunkOffsets []uint64 // relative to the start of the mdat payload
+	chunkSamples []uint32
+}
+
+func (table *sampleTable) addChunk(offset uint64, samples []Sample) {
+	table.chunkOffsets = append(table.chunkOffsets, offset)
+	table.chunkSamples = append(table.chunkSamples, uint32(len(samples)))
+	for _, sample := range samples {
+		table.durations = append(table.durations, sample.Duration)
+		table.sizes = append(table.sizes, sample.Size)
+		table.offsets = append(table.offsets, sample.CompositionOffset)
+		if sample.Sync() {
+			table.sync = append(table.sync, uint32(len(table.durations))) // 1 based
+		}
+	}
+}
+
+func (table *sampleTable) duration() uint64 {
+	total := uint64(0)
+	for _, d := range table.durations {
+		total += uint64(d)
+	}
+	return total
+}
+
+// copies the init moov, dropping mvex, setting the durations and replacing the sample table
+func (table *sampleTable) rebuildMoov(moov []byte, timescale uint32, base uint64, largeOffsets bool) ([]byte, error) {
+	p := NewMP4Parser(moov, nil)
+	moovAtom, err := p.findAtom(moov, "moov")
+	if err != nil {
+		return nil, err
+	}
+	mvhdAtom, err := p.findAtom(moovAtom.Data, "mvhd")
+	if err != nil {
+		return nil, err
+	}
+	movieTimescale := headerTimescale(mvhdAtom.Data)
+	if movieTimescale == 0 {
+		return nil, &BoxError{Type: "mvhd", Err: ErrBoxTruncated}
+	}
+	mediaDuration := table.duration()
+	movieDuration := Rescale(mediaDuration, timescale, movieTimescale)
+
+	rebuilt, err := rewriteChildren(p, moovAtom, func(atom Atom) ([]byte, error) {
+		switch atom.Type {
+		case "mvex":
+			return nil, nil
+		case "mvhd":
+			return setDuration(atom, 16, 24, movieDuration), nil
+		case "trak":
+			return rewriteChildren(p, atom, func(atom Atom) ([]byte, error) {
+				switch atom.Type {
+				case "tkhd":
+					return setDuration(atom, 20, 28, movieDuration), nil
+				case "mdia":
+					return rewriteChildren(p, atom, func(atom Atom) ([]byte, error) {
+						switch atom.Type {
+						case "mdhd":
+							return setDuration(atom, 16, 24, mediaDuration), nil
+						case "minf":
+							return rewriteChildren(p, atom, func(atom Atom) ([]byte, error) {
+								if atom.Type == "stbl" {
+									return table.stbl(p, atom, base, largeOffsets)
+								}
+								return makeBox(atom.Type, atom.Data), nil
+							})
+						}
+						return makeBox(atom.Type, atom.Data), nil
+					})
+				}
+				return makeBox(atom.Type, atom.Data), nil
+			})
+		}
+		return makeBox(atom.Type, atom.Data), nil
+	})
+	return rebuilt, err
+}
+
+// the sample description is kept, every other table is built from the collected samples
+func (table *sampleTable) stbl(p *MP4Parser, stbl Atom, base uint64, largeOffsets bool) ([]byte, error) {
+	stsd, err := p.findAtom(stbl.Data, "stsd")
+	if err != nil {
+		return nil, err
+	}
+
+	// decoding times, run length encoded
+	stts, count := []byte{}, uint32(0)
+	for i := 0; i < len(table.durations); {
+		j := i
+		for j < len(table.durations) && table.durations[j] == table.durations[i] {
+			j++
+		}
+		stts = append(append(stts, u32(uint32(j-i))...), u32(table.durations[i])...)
+		count++
+		i = j
+	}
+	boxes := [][]byte{makeBox("stsd", stsd.Data), makeFullBox("stts", 0, 0, u32(count), stts)}
+
+	// composition offsets, only when the samples are reordered
+	reordered, negative := false, false
+	for _, offset := range table.offsets {
+		reordered = reordered || offset != 0
+		negative = negative || offset < 0
+	}
+	if reordered {
+		ctts, count := []byte{}, uint32(0)
+		for i := 0; i < len(table.offsets); {
+			j := i
+			for j < len(table.offsets) && table.offsets[j] == table.offsets[i] {
+				j++
+			}
+			ctts = append(append(ctts, u32(uint32(j-i))...), u32(uint32(table.offsets[i]))...)
+			count++
+			i = j
+		}
+		version := byte(0)
+		if negative {
+			version = 1
+		}
+		boxes = append(boxes, makeFullBox("ctts", version, 0, u32(count), ctts))
+	}
+
+	// every sample a sync sample needs no stss
+	if len(table.sync) < len(table.durations) {
+		stss := make([]byte, 0, 4*len(table.sync))
+		for _, n := range table.sync {
+			stss = append(stss, u32(n)...)
+		}
+		boxes = append(boxes, makeFullBox("stss", 0, 0, u32(uint32(len(table.sync))), stss))
+	}
+
+	// chunks with the same number of samples share the stsc entry of the first one
+	stsc, count := []byte{}, uint32(0)
+	for i, samples := range table.chunkSamples {
+		if i > 0 && samples == table.chunkSamples[i-1] {
+			continue
+		}
+		stsc = append(append(append(stsc, u32(uint32(i+1))...), u32(samples)...), u32(1)...)
+		count++
+	}
+	boxes = append(boxes, makeFullBox("stsc", 0, 0, u32(count), stsc))
+
+	stsz := make([]byte, 0, 4*len(table.sizes))
+	for _, size := range table.sizes {
+		stsz = append(stsz, u32(size)...)
+	}
+	boxes = append(boxes, makeFullBox("stsz", 0, 0, u32(0), u32(uint32(len(table.sizes))), stsz))
+
+	offsets := make([]byte, 0, 8*len(table.chunkOffsets))
+	for _, offset := range table.chunkOffsets {
+		if largeOffsets {
+			offsets = append(offsets, u64(base+offset)...)
+		} else {
+			offsets = append(offsets, u32(uint32(base+offset))...)
+		}
+	}
+	chunkOffsetBox := "stco"
+	if largeOffsets {
+		chunkOffsetBox = "co64"
+	}
+	boxes = append(boxes, makeFullBox(chunkOffsetBox, 0, 0, u32(uint32(len(table.chunkOffsets))), offsets))
+
+	return makeBox("stbl", boxes...), nil
+}
+
+// rebuilds a container box, rewrite returns the new bytes of each child (nil drops it)
+func rewriteChildren(p *MP4Parser, container Atom, rewrite func(Atom) ([]byte, error)) ([]byte, error) {
+	children := [][]byte{}
+	for offset := 0; offset < len(container.Data); {
+		atom, next, err := p.readAtom(container.Data, offset)
+		if err != nil {
+			return nil, err
+		}
+		child, err := rewrite(atom)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+		offset = next
+	}
+	return makeBox(container.Type, children...), nil
+}
+
+// timescale of mvhd/mdhd, after the 32 or 64 bit creation and modification times
+func headerTimescale(data []byte) uint32 {
+	offset := 12
+	if len(data) > 0 && data[0] == 1 {
+		offset = 20
+	}
+	if len(data) < offset+4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(data[offset : offset+4])
+}
+
+// copy of a full box with its duration field replaced, at offset v0 (32 bit) or v1 (64 bit) of the payload
+func setDuration(atom Atom, v0, v1 int, duration uint64) []byte {
+	data := append([]byte(nil), atom.Data...)
+	if len(data) > 0 && data[0] == 1 && len(data) >= v1+8 {
+		binary.BigEndian.PutUint64(data[v1:v1+8], duration)
+	} else if len(data) >= v0+4 {
+		binary.BigEndian.PutUint32(data[v0:v0+4], uint32(min(duration, 0xFFFFFFFF)))
+	}
+	return makeBox(atom.Type, data)
+}
+
+func makeBoxHeader(atomType string, payloadSize uint64, large bool) []byte {
+	if large {
+		return append(append(u32(1), atomType...), u64(payloadSize+16)...)
+	}
+	return append(u32(uint32(payloadSize+8)), atomType...)
+}
+
+func makeBox(atomType string, payload ...[]byte) []byte {
+	size := uint64(0)
+	for _, p := range payload {
+		size += uint64(len(p))
+	}
+	box := makeBoxHeader(atomType, size, size+8 > 0xFFFFFFFF)
+	for _, p := range payload {
+		box = append(box, p...)
+	}
+	return box
+}
+
+func makeFullBox(atomType string, version byte, flags uint32, payload ...[]byte) []byte {
+	return makeBox(atomType, append([][]byte{u32(uint32(version)<<24 | flags&0x00FFFFFF)}, payload...)...)
+}
+
+func u32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func u64(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
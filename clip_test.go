@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// the clip answered for the query, with its status
+func getClip(t *testing.T, url, query string) (int, []byte) {
+	t.Helper()
+	response, err := http.Get(url + "/test/v/clip?" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.StatusCode, body
+}
+
+// the payload of the box found along the path of box types
+func findPath(t *testing.T, data []byte, path ...string) []byte {
+	t.Helper()
+	p := NewMP4Parser(nil, nil)
+	for _, atomType := range path {
+		atom, err := p.findAtom(data, atomType)
+		if err != nil {
+			t.Fatalf("%v: %v", path, err)
+		}
+		data = atom.Data
+	}
+	return data
+}
+
+// the entries of a full box table of 32 bit fields, after version/flags and the fields before the entry count
+func tableEntries(data []byte, skip int) []uint32 {
+	data = data[4+4*skip:]
+	entries := []uint32{}
+	for b := data[4:]; len(b) >= 4; b = b[4:] {
+		entries = append(entries, binary.BigEndian.Uint32(b))
+	}
+	return entries
+}
+
+func TestClipFragmented(t *testing.T) {
+	_, server := newTestServer(t, STORE_HEAP, false)
+	// from inside the first segment to inside the second one: both whole, the third left out
+	status, clip := getClip(t, server.URL, "from=100000&to=200000")
+	if status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+	fragments := []byte{}
+	for seq := uint32(1); seq <= 4; seq++ {
+		fragments = append(fragments, testFragment(seq, uint64(seq-1)*TEST_SAMPLES*TEST_SAMPLE_DURATION, seq%2 == 1)...)
+	}
+	mfra := findPath(t, clip, "mfra")
+	header := len(clip) - len(fragments) - len(mfra) - 8 // ftyp + moov
+	if !bytes.Equal(clip[header:header+len(fragments)], fragments) {
+		t.Fatal("fragments not copied as ingested")
+	}
+	if !bytes.Equal(findPath(t, clip[:header], "moov"), findPath(t, testInit(), "moov")) {
+		t.Error("init segment not copied")
+	}
+
+	// a tfra entry per keyframe, at the offset of its moof in the file
+	tfra := findPath(t, mfra, "tfra")
+	if count := binary.BigEndian.Uint32(tfra[12:16]); count != 2 {
+		t.Fatalf("%d tfra entries", count)
+	}
+	for i, want := range []struct {
+		time uint64
+		seq  uint32
+	}{{0, 1}, {2 * TEST_SAMPLES * TEST_SAMPLE_DURATION, 3}} {
+		entry := tfra[16+19*i:]
+		time, offset := binary.BigEndian.Uint64(entry), binary.BigEndian.Uint64(entry[8:])
+		moof := testMoof(testFragment(want.seq, want.time, true))
+		if time != want.time || offset > uint64(len(clip)) || !bytes.HasPrefix(clip[offset:], moof) {
+			t.Errorf("tfra entry %d at time %d points at %d, not at the moof of fragment %d", i, time, offset, want.seq)
+		}
+	}
+	mfro := findPath(t, mfra, "mfro")
+	if size := binary.BigEndian.Uint32(mfro[4:]); size != uint32(len(mfra)+8) {
+		t.Errorf("mfro size %d of a %d bytes mfra", size, len(mfra)+8)
+	}
+}
+
+func TestClipProgressive(t *testing.T) {
+	_, server := newTestServer(t, STORE_HEAP, false)
+	status, clip := getClip(t, server.URL, fmt.Sprintf("from=0&to=%d&format=mp4", 4*TEST_SAMPLES*TEST_SAMPLE_DURATION))
+	if status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+	stbl := findPath(t, clip, "moov", "trak", "mdia", "minf", "stbl")
+	if mvex, _ := NewMP4Parser(nil, nil).findAtom(findPath(t, clip, "moov"), "mvex"); mvex.Type != "" {
+		t.Error("mvex left in a progressive file")
+	}
+
+	// every sample lasts the same
+	if stts := tableEntries(findPath(t, stbl, "stts"), 0); len(stts) != 2 || stts[0] != 4*TEST_SAMPLES || stts[1] != TEST_SAMPLE_DURATION {
+		t.Errorf("stts %v", stts)
+	}
+	// the first sample of fragments 1 and 3
+	if stss := tableEntries(findPath(t, stbl, "stss"), 0); len(stss) != 2 || stss[0] != 1 || stss[1] != 2*TEST_SAMPLES+1 {
+		t.Errorf("stss %v", stss)
+	}
+
+	// a chunk per fragment, holding its samples as found in its mdat
+	sizes := tableEntries(findPath(t, stbl, "stsz"), 1)
+	offsets := tableEntries(findPath(t, stbl, "stco"), 0)
+	if len(sizes) != 4*TEST_SAMPLES || len(offsets) != 4 {
+		t.Fatalf("%d sample sizes, %d chunk offsets", len(sizes), len(offsets))
+	}
+	for i, offset := range offsets {
+		seq := uint32(i + 1)
+		fragment := testFragment(seq, uint64(i)*TEST_SAMPLES*TEST_SAMPLE_DURATION, seq%2 == 1)
+		samples := fragment[len(testMoof(fragment))+8:] // mdat payload
+		size := uint32(0)
+		for _, sampleSize := range sizes[i*TEST_SAMPLES : (i+1)*TEST_SAMPLES] {
+			size += sampleSize
+		}
+		if size != uint32(len(samples)) || int(offset)+len(samples) > len(clip) || !bytes.Equal(clip[offset:int(offset)+len(samples)], samples) {
+			t.Errorf("chunk %d at %d of %d bytes does not hold the samples of fragment %d", i, offset, size, seq)
+		}
+	}
+	if mdat := findPath(t, clip, "mdat"); len(mdat) != len(clip)-int(offsets[0]) {
+		t.Errorf("mdat of %d bytes, samples from %d of %d", len(mdat), offsets[0], len(clip))
+	}
+}
+
+func TestClipBounds(t *testing.T) {
+	_, server := newTestServer(t, STORE_HEAP, false)
+	second := uint64(TEST_SAMPLES * TEST_SAMPLE_DURATION)
+	for _, test := range []struct {
+		query    string
+		status   int
+		segments uint32 // keyframes in the clip
+	}{
+		{"from=0&to=1", http.StatusOK, 1},
+		{fmt.Sprintf("from=%d&to=%d", 5*second, 100*second), http.StatusOK, 1},       // up to the last complete fragment
+		{fmt.Sprintf("from=%d&to=%d", 3*second+1, 4*second-1), http.StatusOK, 1},     // within a segment
+		{fmt.Sprintf("from=%d&to=%d", 10*second, 20*second), http.StatusNotFound, 0}, // after the window
+		{fmt.Sprintf("from=%d&to=%d", 6*second, 7*second), http.StatusNotFound, 0},   // right after the last fragment
+		{fmt.Sprintf("from=%d&to=%d", 2*second, second), http.StatusBadRequest, 0},   // reversed
+		{fmt.Sprintf("from=%d&to=%d", second, second), http.StatusBadRequest, 0},     // empty
+		{"from=0&to=x", http.StatusBadRequest, 0},
+		{"from=0&to=1&format=mkv", http.StatusBadRequest, 0},
+	} {
+		status, clip := getClip(t, server.URL, test.query)
+		if status != test.status {
+			t.Errorf("%s: status %d, want %d", test.query, status, test.status)
+			continue
+		}
+		if test.segments == 0 {
+			continue
+		}
+		tfra := findPath(t, findPath(t, clip, "mfra"), "tfra")
+		if count := binary.BigEndian.Uint32(tfra[12:16]); count != test.segments {
+			t.Errorf("%s: %d keyframes, want %d", test.query, count, test.segments)
+		}
+	}
+}
+
+func TestClipEvicted(t *testing.T) {
+	stream, server := newTestServer(t, STORE_HEAP, false)
+	var source []byte
+	for i := 6; i < 30; i++ {
+		source = append(source, testFragment(uint32(i+1), uint64(i*TEST_SAMPLES*TEST_SAMPLE_DURATION), i%2 == 0)...)
+	}
+	stream.Ingest(bytes.NewReader(source))
+	// the heap keeps the last 10 fragments, the first seconds left the window
+	if status, _ := getClip(t, server.URL, "from=0&to=180000"); status != http.StatusNotFound {
+		t.Errorf("clip of evicted fragments answered %d, expected %d", status, http.StatusNotFound)
+	}
+	if status, segments := getClip(t, server.URL, "from=2520000&to=2700000"); status != http.StatusOK || len(segments) == 0 {
+		t.Errorf("clip inside the window answered %d", status)
+	}
+}
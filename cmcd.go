@@ -0,0 +1,270 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	CMCD_SESSION_TIMEOUT = 60 * time.Second // sessions not heard of for this long are dropped
+	CMCD_MAX_SESSIONS    = 10000            // per channel, the least recently seen session makes room for a new one
+)
+
+// Cmcd is the Common Media Client Data (CTA-5004) of a request, keys without value (booleans) are "true"
+type Cmcd map[string]string
+
+// headers carrying CMCD, the same keys may be sent in the CMCD query parameter instead
+var cmcdHeaders = []string{"CMCD-Object", "CMCD-Request", "CMCD-Session", "CMCD-Status"}
+
+// ParseCmcd reads the CMCD headers and query parameter of the request
+func ParseCmcd(r *http.Request) Cmcd {
+	data := Cmcd{}
+	for _, header := range cmcdHeaders {
+		for _, value := range r.Header.Values(header) {
+			data.parse(value)
+		}
+	}
+	if query := r.URL.Query().Get("CMCD"); query != "" {
+		data.parse(query)
+	}
+	return data
+}
+
+func (data Cmcd) parse(list string) {
+	for _, item := range splitCmcd(list) {
+		key, value, found := strings.Cut(strings.TrimSpace(item), "=")
+		if key == "" {
+			continue
+		}
+		if !found {
+			data[key] = "true"
+			continue
+		}
+		if strings.HasPrefix(value, `"`) {
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				continue
+			}
+			value = unquoted
+		}
+		data[key] = value
+	}
+}
+
+// splits on the commas outside of quoted strings
+func splitCmcd(list string) []string {
+	items := []string{}
+	quoted, escaped, start := false, false, 0
+	for i, c := range list {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			items = append(items, list[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, list[start:])
+}
+
+func (data Cmcd) uint(key string) (uint64, bool) {
+	value, err := strconv.ParseUint(data[key], 10, 64)
+	return value, err == nil
+}
+
+// CmcdSession is the latest state reported by a player session
+type CmcdSession struct {
+	Id                  string    `json:"sid"`
+	Channel             string    `json:"channel,omitempty"`
+	ContentId           string    `json:"cid,omitempty"`
+	Representation      string    `json:"representation,omitempty"` // of the last segment requested
+	StreamingFormat     string    `json:"sf,omitempty"`
+	Bitrate             uint64    `json:"br,omitempty"`  // encoded bitrate of the last object requested [kbps]
+	TopBitrate          uint64    `json:"tb,omitempty"`  // highest bitrate the player can play [kbps]
+	BufferLength        uint64    `json:"bl"`            // [ms]
+	Throughput          uint64    `json:"mtp,omitempty"` // measured by the player [kbps]
+	RequestedThroughput uint64    `json:"rtp,omitempty"` // requested maximum [kbps]
+	PlaybackRate        string    `json:"pr,omitempty"`
+	Starved             bool      `json:"bs"`     // the last request reported a buffer starvation
+	Stalls              uint64    `json:"stalls"` // requests that reported a buffer starvation
+	Requests            uint64    `json:"requests"`
+	DeliveryRate        uint64    `json:"etp,omitempty"` // measured by the server on the segments sent, the CMSD etp [kbps]
+	Remote              string    `json:"remote"`
+	FirstSeen           time.Time `json:"first_seen"`
+	LastSeen            time.Time `json:"last_seen"`
+}
+
+// CmcdSessions is the session table of a channel
+type CmcdSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*list.Element // of the *CmcdSession in recent, by session id
+	recent   list.List                // most recently seen first, evicted and expired from the back
+	stalls   atomic.Uint64            // ever reported, sessions expire
+	requests atomic.Uint64
+}
+
+// update records the data of a request, requests without session id cannot be told apart and are ignored
+func (table *CmcdSessions) update(data Cmcd, channel, representation, remote string, now time.Time) {
+	sid := data["sid"]
+	if sid == "" {
+		return
+	}
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	if table.sessions == nil {
+		table.sessions = map[string]*list.Element{}
+	}
+	element, ok := table.sessions[sid]
+	if ok {
+		table.recent.MoveToFront(element)
+	} else {
+		table.prune(now)
+		if len(table.sessions) >= CMCD_MAX_SESSIONS {
+			table.remove(table.recent.Back())
+		}
+		element = table.recent.PushFront(&CmcdSession{Id: sid, Channel: channel, FirstSeen: now})
+		table.sessions[sid] = element
+	}
+
+	session := element.Value.(*CmcdSession)
+	session.Requests++
+	session.LastSeen = now
+	session.Remote = remote
+	if representation != "" {
+		session.Representation = representation
+	}
+	if cid, ok := data["cid"]; ok {
+		session.ContentId = cid
+	}
+	if sf, ok := data["sf"]; ok {
+		session.StreamingFormat = sf
+	}
+	if pr, ok := data["pr"]; ok {
+		session.PlaybackRate = pr
+	}
+	for key, field := range map[string]*uint64{
+		"br":  &session.Bitrate,
+		"tb":  &session.TopBitrate,
+		"bl":  &session.BufferLength,
+		"mtp": &session.Throughput,
+		"rtp": &session.RequestedThroughput,
+	} {
+		if value, ok := data.uint(key); ok {
+			*field = value
+		}
+	}
+	session.Starved = data["bs"] == "true"
+	if session.Starved {
+		session.Stalls++
+		table.stalls.Add(1)
+	}
+	table.requests.Add(1)
+}
+
+// drops the sessions not heard of within the timeout, the caller holds the lock
+func (table *CmcdSessions) prune(now time.Time) {
+	for oldest := table.recent.Back(); oldest != nil && now.Sub(oldest.Value.(*CmcdSession).LastSeen) > CMCD_SESSION_TIMEOUT; oldest = table.recent.Back() {
+		table.remove(oldest)
+	}
+}
+
+func (table *CmcdSessions) remove(element *list.Element) {
+	delete(table.sessions, element.Value.(*CmcdSession).Id)
+	table.recent.Remove(element)
+}
+
+// Sessions returns a copy of the active sessions, the most recently seen first
+func (table *CmcdSessions) Sessions() []CmcdSession {
+	table.mu.Lock()
+	table.prune(time.Now())
+	sessions := make([]CmcdSession, 0, len(table.sessions))
+	for element := table.recent.Front(); element != nil; element = element.Next() {
+		sessions = append(sessions, *element.Value.(*CmcdSession))
+	}
+	table.mu.Unlock()
+	return sessions
+}
+
+// CmcdSummary is what the players of a channel report as a whole, sent along with the forecast
+type CmcdSummary struct {
+	Sessions        int            `json:"sessions"`
+	Starved         int            `json:"starved"` // sessions whose last request reported a buffer starvation
+	BufferLength    uint64         `json:"bl"`      // median of the sessions reporting it [ms]
+	Throughput      uint64         `json:"mtp"`     // median of the sessions reporting it [kbps]
+	Representations map[string]int `json:"representations"`
+}
+
+// Summary of the active sessions, nil when there are none
+func (table *CmcdSessions) Summary() *CmcdSummary {
+	sessions := table.Sessions()
+	if len(sessions) == 0 {
+		return nil
+	}
+	summary := &CmcdSummary{Sessions: len(sessions), Representations: map[string]int{}}
+	buffers, throughputs := []uint64{}, []uint64{}
+	for _, session := range sessions {
+		if session.Starved {
+			summary.Starved++
+		}
+		if session.Representation != "" {
+			summary.Representations[session.Representation]++
+		}
+		if session.BufferLength > 0 {
+			buffers = append(buffers, session.BufferLength)
+		}
+		if session.Throughput > 0 {
+			throughputs = append(throughputs, session.Throughput)
+		}
+	}
+	summary.BufferLength = median(buffers)
+	summary.Throughput = median(throughputs)
+	return summary
+}
+
+func median(values []uint64) uint64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	return values[len(values)/2]
+}
+
+// collectCmcd records the CMCD of the requests to the channel before serving them
+func (channel *Channel) collectCmcd(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if data := ParseCmcd(r); len(data) > 0 {
+			representation := ""
+			rest := strings.TrimPrefix(r.URL.Path, channel.Root+"/")
+			if id, _, found := strings.Cut(rest, "/"); found && channel.stream(id) != nil {
+				representation = id
+			}
+			channel.cmcd.update(data, channel.Name, representation, clientIP(r), time.Now())
+		}
+		next(w, r)
+	}
+}
+
+// CmcdHandler lists the active player sessions on GET {Root}/admin/sessions[?channel={name}]
+func CmcdHandler(w http.ResponseWriter, r *http.Request) {
+	sessions := []CmcdSession{}
+	for _, channel := range channels {
+		if r.URL.Query().Has("channel") && channel.Name != r.URL.Query().Get("channel") {
+			continue
+		}
+		sessions = append(sessions, channel.cmcd.Sessions()...)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(sessions)
+}
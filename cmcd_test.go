@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCmcdSessionsFull(t *testing.T) {
+	var table CmcdSessions
+	now := time.Now()
+	for i := 0; i < CMCD_MAX_SESSIONS; i++ {
+		table.update(Cmcd{"sid": fmt.Sprint(i)}, "test", "v", "127.0.0.1", now.Add(time.Duration(i)*time.Microsecond))
+	}
+	// the first session comes back, the second one is now the least recently seen
+	now = now.Add(time.Second)
+	table.update(Cmcd{"sid": "0", "bl": "2000"}, "test", "v", "127.0.0.1", now)
+	table.update(Cmcd{"sid": "new"}, "test", "v", "127.0.0.1", now)
+
+	sessions := table.Sessions()
+	if len(sessions) != CMCD_MAX_SESSIONS {
+		t.Fatalf("%d sessions, at most %d expected", len(sessions), CMCD_MAX_SESSIONS)
+	}
+	if sessions[0].Id != "new" || sessions[1].Id != "0" || sessions[1].BufferLength != 2000 || sessions[1].Requests != 2 {
+		t.Errorf("most recently seen %+v, %+v", sessions[0], sessions[1])
+	}
+	if oldest := sessions[len(sessions)-1].Id; oldest != "2" {
+		t.Errorf("least recently seen %s, 1 should have been evicted", oldest)
+	}
+	for _, session := range sessions {
+		if session.Id == "1" {
+			t.Error("session 1 not evicted")
+		}
+	}
+}
+
+func TestCmcdSessionsExpire(t *testing.T) {
+	var table CmcdSessions
+	now := time.Now()
+	table.update(Cmcd{"sid": "gone"}, "test", "v", "127.0.0.1", now.Add(-2*CMCD_SESSION_TIMEOUT))
+	table.update(Cmcd{"sid": "idle"}, "test", "v", "127.0.0.1", now.Add(-CMCD_SESSION_TIMEOUT/2))
+	table.update(Cmcd{"sid": "active"}, "test", "v", "127.0.0.1", now)
+
+	sessions := table.Sessions()
+	if len(sessions) != 2 || sessions[0].Id != "active" || sessions[1].Id != "idle" {
+		t.Errorf("sessions %+v", sessions)
+	}
+	if len(table.sessions) != table.recent.Len() {
+		t.Errorf("%d sessions indexed, %d listed", len(table.sessions), table.recent.Len())
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	CMSD_SERVER      = "ruddr"   // identifier of the CMSD-Dynamic entry written by this server
+	CMSD_MIN_SAMPLE  = 256 << 10 // smaller responses fit the socket buffers, their write time says nothing of the path [bytes]
+	CMSD_RATE_WEIGHT = 0.2       // of a new delivery rate sample in the moving average
+)
+
+// cmsdHeaders sets the CMSD-Static and CMSD-Dynamic (CTA-5006) headers of a segment response starting at keyframe,
+// segment is nil while the segment is still being produced (chunked), its duration and successor are not known yet
+func (stream *InputStream) cmsdHeaders(w http.ResponseWriter, r *http.Request, keyframe *Fragment, segment []*Fragment) {
+	static := []string{}
+	edge := segment == nil
+	if segment != nil {
+		last := segment[len(segment)-1]
+		var duration uint64
+		for _, frag := range segment {
+			duration += frag.Duration
+		}
+		static = append(static,
+			fmt.Sprintf("at=%d", last.ingested.UnixMilli()), // availability time, when the last fragment was received
+			fmt.Sprintf("d=%d", duration*1000/uint64(keyframe.Timescale)),
+		)
+		// the segment following this one is not complete yet
+		next, ok := stream.fragments.Get(last.Sequence + 1)
+		if ok {
+			following, _ := stream.GetNextFragments(next)
+			edge = following == nil
+		}
+	}
+	switch stream.repr.Type {
+	case "video":
+		static = append(static, "ot=v")
+	case "audio":
+		static = append(static, "ot=a")
+	}
+	static = append(static, "st=l", "v=1")
+	if segment != nil {
+		static = append(static, fmt.Sprintf("ruddr-nk=%d", keyframe.Sequence+uint32(len(segment)))) // sequence of the next keyframe
+	}
+	w.Header().Set("CMSD-Static", strings.Join(static, ","))
+
+	dynamic := fmt.Sprintf("%q", CMSD_SERVER)
+	if etp := stream.estimatedThroughput(r); etp > 0 {
+		dynamic += fmt.Sprintf(";etp=%d", etp)
+	}
+	if edge {
+		dynamic += ";ruddr-edge"
+	}
+	w.Header().Set("CMSD-Dynamic", dynamic)
+}
+
+// estimatedThroughput is the delivery rate of the previous segments to the CMCD session of the request,
+// or to any client of the representation [kbps], 0 when unknown
+func (stream *InputStream) estimatedThroughput(r *http.Request) uint64 {
+	if sid := ParseCmcd(r)["sid"]; sid != "" {
+		if rate := stream.channel.cmcd.deliveryRate(sid); rate > 0 {
+			return rate
+		}
+	}
+	return stream.metrics.deliveryRate.Load()
+}
+
+// delivered records the rate at which a segment response was written
+func (stream *InputStream) delivered(r *http.Request, bytes int64, elapsed time.Duration) {
+	if bytes < CMSD_MIN_SAMPLE || elapsed <= 0 {
+		return
+	}
+	sample := uint64(float64(bytes*8) / elapsed.Seconds() / 1000)
+	stream.metrics.deliveryRate.Store(movingAverage(stream.metrics.deliveryRate.Load(), sample))
+	if sid := ParseCmcd(r)["sid"]; sid != "" {
+		stream.channel.cmcd.delivered(sid, sample)
+	}
+}
+
+func movingAverage(average, sample uint64) uint64 {
+	if average == 0 {
+		return sample
+	}
+	return uint64(CMSD_RATE_WEIGHT*float64(sample) + (1-CMSD_RATE_WEIGHT)*float64(average))
+}
+
+// deliveryRate of the segments sent to the session [kbps], 0 when unknown
+func (table *CmcdSessions) deliveryRate(sid string) uint64 {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	if element, ok := table.sessions[sid]; ok {
+		return element.Value.(*CmcdSession).DeliveryRate
+	}
+	return 0
+}
+
+func (table *CmcdSessions) delivered(sid string, sample uint64) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	if element, ok := table.sessions[sid]; ok {
+		session := element.Value.(*CmcdSession)
+		session.DeliveryRate = movingAverage(session.DeliveryRate, sample)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCmsdAvailabilityTime(t *testing.T) {
+	stream, server := newTestServer(t, STORE_HEAP, false)
+	// the wall clock of the timeline does not matter, the fragments were received now
+	stream.timestamp = stream.timestamp.Add(-time.Hour)
+
+	response, err := http.Get(server.URL + "/test/v/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	static := response.Header.Get("CMSD-Static")
+	want := fmt.Sprintf("at=%d", stream.GetCompleteFragment(4).ingested.UnixMilli())
+	if !strings.Contains(static, want+",") {
+		t.Errorf("CMSD-Static %q, segment complete at %s", static, want)
+	}
+}
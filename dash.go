@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+)
+
+// MPD is the subset of the MPEG-DASH manifest needed to describe a live CMAF ladder
+type MPD struct {
+	XMLName                    xml.Name  `xml:"MPD"`
+	Xmlns                      string    `xml:"xmlns,attr"`
+	Type                       string    `xml:"type,attr"`
+	Profiles                   string    `xml:"profiles,attr"`
+	AvailabilityStartTime      string    `xml:"availabilityStartTime,attr"`
+	PublishTime                string    `xml:"publishTime,attr"`
+	MinimumUpdatePeriod        string    `xml:"minimumUpdatePeriod,attr"`
+	MinBufferTime              string    `xml:"minBufferTime,attr"`
+	TimeShiftBufferDepth       string    `xml:"timeShiftBufferDepth,attr,omitempty"`
+	SuggestedPresentationDelay string    `xml:"suggestedPresentationDelay,attr"`
+	Periods                    []*Period `xml:"Period"`
+	UTCTiming                  UTCTiming `xml:"UTCTiming"`
+}
+
+type Period struct {
+	Id             string           `xml:"id,attr"`
+	Start          string           `xml:"start,attr"`
+	AdaptationSets []*AdaptationSet `xml:"AdaptationSet"`
+}
+
+type AdaptationSet struct {
+	ContentType      string                `xml:"contentType,attr"`
+	MimeType         string                `xml:"mimeType,attr"`
+	SegmentAlignment bool                  `xml:"segmentAlignment,attr"`
+	StartWithSAP     int                   `xml:"startWithSAP,attr"`
+	Representations  []*DashRepresentation `xml:"Representation"`
+}
+
+type DashRepresentation struct {
+	Id                        string                     `xml:"id,attr"`
+	Bandwidth                 uint64                     `xml:"bandwidth,attr"`
+	Width                     uint32                     `xml:"width,attr,omitempty"`
+	Height                    uint32                     `xml:"height,attr,omitempty"`
+	Codecs                    string                     `xml:"codecs,attr,omitempty"`
+	FrameRate                 string                     `xml:"frameRate,attr,omitempty"`
+	Sar                       string                     `xml:"sar,attr,omitempty"`
+	AudioSamplingRate         uint32                     `xml:"audioSamplingRate,attr,omitempty"`
+	AudioChannelConfiguration *AudioChannelConfiguration `xml:"AudioChannelConfiguration,omitempty"`
+	SegmentTemplate           SegmentTemplate            `xml:"SegmentTemplate"`
+}
+
+type AudioChannelConfiguration struct {
+	SchemeIdUri string `xml:"schemeIdUri,attr"`
+	Value       uint16 `xml:"value,attr"`
+}
+
+type SegmentTemplate struct {
+	Timescale              uint32          `xml:"timescale,attr"`
+	PresentationTimeOffset uint64          `xml:"presentationTimeOffset,attr,omitempty"` // decode time at the period start
+	Initialization         string          `xml:"initialization,attr"`
+	Media                  string          `xml:"media,attr"`
+	SegmentTimeline        SegmentTimeline `xml:"SegmentTimeline"`
+}
+
+type SegmentTimeline struct {
+	S []TimelineSegment `xml:"S"`
+}
+
+// TimelineSegment is a run of R+1 segments of duration D starting at T
+type TimelineSegment struct {
+	T uint64 `xml:"t,attr"`
+	D uint64 `xml:"d,attr"`
+	R int    `xml:"r,attr,omitempty"`
+}
+
+type UTCTiming struct {
+	SchemeIdUri string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+}
+
+// DashHandler renders a dynamic MPD with a Period per generation (the segments between encoder restarts) and
+// one SegmentTimeline per representation, built from the keyframes window
+func (channel *Channel) DashHandler(w http.ResponseWriter, r *http.Request) {
+	streams := channel.Streams()
+	if len(streams) == 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	start, _ := channel.commonTimeline()
+	now := time.Now()
+	fragmentDuration := time.Duration(channel.ingester().FragmentDuration) * time.Millisecond
+	credentials := authQuery(r)
+
+	// a period starts with the first fragment of its generation, the latest one among the representations
+	periodStarts := map[uint32]time.Time{}
+	generations := map[*InputStream][]uint32{}
+	for _, stream := range streams {
+		if stream.moov == nil || stream.timescale == 0 {
+			continue // not initialized yet
+		}
+		for _, generation := range stream.generations() {
+			init := stream.init(generation)
+			if init == nil || init.timescale == 0 {
+				continue
+			}
+			generations[stream] = append(generations[stream], generation)
+			if periodStart := stream.wallClock(init.pts, init.timescale); periodStart.After(periodStarts[generation]) {
+				periodStarts[generation] = periodStart
+			}
+		}
+	}
+
+	periods := []*Period{}
+	for _, generation := range slices.Sorted(maps.Keys(periodStarts)) {
+		periodStart := periodStarts[generation]
+		adaptationSets := map[string]*AdaptationSet{}
+		for _, stream := range streams {
+			if !slices.Contains(generations[stream], generation) {
+				continue
+			}
+			set, ok := adaptationSets[stream.repr.Type]
+			if !ok {
+				set = &AdaptationSet{
+					ContentType:      stream.repr.Type,
+					MimeType:         stream.repr.Type + "/mp4",
+					SegmentAlignment: true,
+					StartWithSAP:     1,
+				}
+				adaptationSets[stream.repr.Type] = set
+			}
+			// the decode time of the period start, the representation may have started a little earlier
+			init := stream.init(generation)
+			late := periodStart.Sub(stream.wallClock(init.pts, init.timescale))
+			representation := &DashRepresentation{
+				Id:        stream.repr.Id,
+				Bandwidth: stream.Bandwidth(),
+				Width:     stream.repr.Width,
+				Height:    stream.repr.Height,
+				Codecs:    stream.repr.Codecs,
+				FrameRate: FrameRateString(stream.repr.FrameRate),
+				Sar:       stream.repr.Sar,
+				SegmentTemplate: SegmentTemplate{
+					Timescale:              init.timescale,
+					PresentationTimeOffset: init.tfdt + Rescale(uint64(late), uint32(time.Second), init.timescale),
+					Initialization:         fmt.Sprintf("$RepresentationID$/init-%d.mp4%s", generation, credentials),
+					Media:                  fmt.Sprintf("$RepresentationID$/t/%d/$Time$%s", generation, credentials),
+					SegmentTimeline:        stream.SegmentTimeline(generation),
+				},
+			}
+			if stream.repr.Type == AUDIO {
+				representation.AudioSamplingRate = stream.repr.SampleRate
+				representation.AudioChannelConfiguration = &AudioChannelConfiguration{
+					SchemeIdUri: "urn:mpeg:dash:23003:3:audio_channel_configuration:2011",
+					Value:       stream.repr.Channels,
+				}
+			}
+			set.Representations = append(set.Representations, representation)
+		}
+
+		sets := []*AdaptationSet{}
+		for _, contentType := range []string{VIDEO, AUDIO} {
+			if set, ok := adaptationSets[contentType]; ok {
+				sort.Slice(set.Representations, func(i, j int) bool {
+					return set.Representations[i].Id < set.Representations[j].Id
+				})
+				sets = append(sets, set)
+			}
+		}
+		periods = append(periods, &Period{
+			Id:             fmt.Sprintf("%d", generation),
+			Start:          isoDuration(max(0, periodStart.Sub(start))),
+			AdaptationSets: sets,
+		})
+	}
+
+	mpd := MPD{
+		Xmlns:                      "urn:mpeg:dash:schema:mpd:2011",
+		Type:                       "dynamic",
+		Profiles:                   "urn:mpeg:dash:profile:isoff-live:2011",
+		AvailabilityStartTime:      start.UTC().Format(time.RFC3339Nano),
+		PublishTime:                now.UTC().Format(time.RFC3339Nano),
+		MinimumUpdatePeriod:        isoDuration(fragmentDuration),
+		MinBufferTime:              isoDuration(fragmentDuration * 2),
+		TimeShiftBufferDepth:       channel.timeShiftBufferDepth(),
+		SuggestedPresentationDelay: isoDuration(fragmentDuration * time.Duration(channel.ingester().Horizon)),
+		Periods:                    periods,
+		UTCTiming: UTCTiming{
+			SchemeIdUri: "urn:mpeg:dash:utc:direct:2014",
+			Value:       now.UTC().Format(time.RFC3339Nano),
+		},
+	}
+
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+	w.Header().Set("Content-Type", "application/dash+xml")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprint(w, xml.Header)
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(mpd); err != nil {
+		httpLog.Warn("writing MPD", "error", err)
+	}
+}
+
+// generations of the keyframes window, in order
+func (stream *InputStream) generations() []uint32 {
+	generations := []uint32{}
+	for _, keyframe := range stream.DvrKeyframes() {
+		if n := len(generations); n == 0 || generations[n-1] != keyframe.generation {
+			generations = append(generations, keyframe.generation)
+		}
+	}
+	return generations
+}
+
+// SegmentTimeline lists the complete segments (closed by the following keyframe) of a generation in the keyframes
+// window, at the decode time of the source in its init segment timescale
+func (stream *InputStream) SegmentTimeline(generation uint32) SegmentTimeline {
+	timeline := SegmentTimeline{}
+	init := stream.init(generation)
+	if init == nil || init.timescale == 0 {
+		return timeline
+	}
+	keyframes := stream.DvrKeyframes()
+	for i := 0; i+1 < len(keyframes); i++ {
+		if keyframes[i].generation != generation {
+			continue
+		}
+		t := keyframes[i].Pts - init.pts + init.tfdt
+		d := stream.segmentEnd(keyframes, i) - keyframes[i].Pts
+
+		// repeat the previous entry when the duration does not change
+		if n := len(timeline.S); n > 0 {
+			last := &timeline.S[n-1]
+			if last.D == d && last.T+last.D*uint64(last.R+1) == t {
+				last.R++
+				continue
+			}
+		}
+		timeline.S = append(timeline.S, TimelineSegment{T: t, D: d})
+	}
+	return timeline
+}
+
+// the memory window, or the archive window when there is a longer one on disk, empty when unbounded
+func (channel *Channel) timeShiftBufferDepth() string {
+	depth := time.Duration(channel.ingester().FragmentDuration) * time.Millisecond * time.Duration(channel.ingester().HeapSize)
+	archive := config.Load().Archive
+	if archive.Directory != "" {
+		if archive.Window == 0 {
+			return ""
+		}
+		depth = max(depth, time.Duration(archive.Window)*time.Second)
+	}
+	return isoDuration(depth)
+}
+
+func isoDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", d.Seconds())
+}
+
+// FrameRateString formats a frame rate as an integer or a fraction (30000/1001), the only forms MPD allows
+func FrameRateString(rate float32) string {
+	r := float64(rate)
+	switch {
+	case r <= 0:
+		return ""
+	case math.Abs(r-math.Round(r)) < 0.01:
+		return fmt.Sprintf("%d", int(math.Round(r)))
+	case math.Abs(r*1.001-math.Round(r*1.001)) < 0.01:
+		return fmt.Sprintf("%d/1001", int(math.Round(r*1.001))*1000)
+	default:
+		return fmt.Sprintf("%d/1000", int(math.Round(r*1000)))
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDashPeriods(t *testing.T) {
+	stream := newTestStream(t, STORE_HEAP)
+	stream.channel.streams = append(stream.channel.streams, stream)
+	stream.Serve()
+	server := httptest.NewServer(http.HandlerFunc(stream.channel.route))
+	defer server.Close()
+
+	// the first encoder starts at decode time 10s, a minute later the second one at 0
+	first := uint64(10 * TEST_TIMESCALE)
+	source := testInit()
+	for i := 0; i < 4; i++ {
+		source = append(source, testFragment(uint32(i+1), first+uint64(i*TEST_SAMPLES*TEST_SAMPLE_DURATION), i%2 == 0)...)
+	}
+	stream.Ingest(bytes.NewReader(source))
+	if start := stream.wallClock(stream.keyframes[0].Pts, stream.keyframes[0].Timescale); !start.Equal(stream.timestamp) {
+		t.Errorf("first fragment started at %s, the stream at %s", start, stream.timestamp)
+	}
+	stream.timestamp = stream.timestamp.Add(-time.Minute)
+	stream.Ingest(bytes.NewReader(testSource(4, 2)))
+
+	w := httptest.NewRecorder()
+	stream.channel.DashHandler(w, httptest.NewRequest(http.MethodGet, "/test/manifest.mpd", nil))
+	mpd := MPD{}
+	if err := xml.Unmarshal(w.Body.Bytes(), &mpd); err != nil {
+		t.Fatal(err)
+	}
+	if mpd.AvailabilityStartTime != stream.timestamp.UTC().Format(time.RFC3339Nano) {
+		t.Errorf("availabilityStartTime %s, first fragment at %s", mpd.AvailabilityStartTime, stream.timestamp)
+	}
+	if len(mpd.Periods) != 2 {
+		t.Fatalf("%d periods:\n%s", len(mpd.Periods), w.Body)
+	}
+	for i, want := range []struct {
+		id, initialization, media string
+		pto                       uint64
+		start                     time.Duration
+		repeat                    int
+	}{
+		{"1", "$RepresentationID$/init-1.mp4", "$RepresentationID$/t/1/$Time$", first, 0, 1},
+		{"2", "$RepresentationID$/init-2.mp4", "$RepresentationID$/t/2/$Time$", 0, time.Minute, 0}, // the last segment is in progress
+	} {
+		period := mpd.Periods[i]
+		start, _ := time.ParseDuration(strings.ToLower(period.Start[2:]))
+		if period.Id != want.id || (start-want.start).Abs() > time.Second {
+			t.Errorf("period %s starting at %s", period.Id, period.Start)
+		}
+		template := period.AdaptationSets[0].Representations[0].SegmentTemplate
+		if template.PresentationTimeOffset != want.pto || template.Initialization != want.initialization || template.Media != want.media {
+			t.Errorf("period %s template %+v", period.Id, template)
+		}
+		if s := template.SegmentTimeline.S; len(s) != 1 || s[0].T != want.pto || s[0].R != want.repeat {
+			t.Errorf("period %s timeline %+v", period.Id, s)
+		}
+	}
+
+	// segments are addressed by generation and decode time
+	for path, want := range map[string][]byte{
+		"t/1/900000": append(testFragment(1, first, true), testFragment(2, first+TEST_SAMPLES*TEST_SAMPLE_DURATION, false)...),
+		"t/2/0":      testSegment(1),
+		"t/1/0":      nil,
+		"t/3/0":      nil,
+	} {
+		response, err := http.Get(server.URL + "/test/v/" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		if want == nil && response.StatusCode != http.StatusNotFound || want != nil && !bytes.Equal(body, want) {
+			t.Errorf("%s: status %d with %d bytes", path, response.StatusCode, len(body))
+		}
+	}
+}
@@ -2,8 +2,6 @@ module feddynventor/ruddr/m/v2
 
 go 1.24.1
 
-require golang.org/x/sys v0.31.0
-
 require (
 	github.com/BurntSushi/toml v1.5.0
 	github.com/justincormack/go-memfd v0.0.0-20170219213707-6e4af0518993
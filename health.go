@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const STALL_FRAGMENTS = 5 // default stall threshold, in nominal fragment durations
+
+// HealthStatus is the state of a representation as seen by the health endpoints
+type HealthStatus struct {
+	Channel        string   `json:"channel,omitempty"`
+	Representation string   `json:"representation"`
+	Ready          bool     `json:"ready"`
+	Reason         string   `json:"reason,omitempty"`
+	Init           bool     `json:"init"`      // moov received
+	Ingesting      bool     `json:"ingesting"` // a source is connected
+	LastSequence   uint32   `json:"last_sequence"`
+	LastFragment   *float64 `json:"last_fragment_age,omitempty"` // seconds since the last fragment was completed
+}
+
+// representations not receiving fragments for this long are not ready
+func (server Server) stallThreshold(ingester Ingester) time.Duration {
+	if server.StallThreshold == 0 {
+		return STALL_FRAGMENTS * time.Duration(ingester.FragmentDuration) * time.Millisecond
+	}
+	return time.Duration(server.StallThreshold) * time.Millisecond
+}
+
+func (stream *InputStream) Health(now time.Time) HealthStatus {
+	threshold := config.Load().Server.stallThreshold(*stream.channel.ingester())
+	status := HealthStatus{
+		Channel:        stream.channel.Name,
+		Representation: stream.repr.Id,
+		Init:           stream.moov != nil,
+		Ingesting:      stream.ingesting.Load(),
+		LastSequence:   stream.lastSeqNumber.Load(),
+	}
+	if last := stream.metrics.lastIngest.Load(); last != 0 {
+		age := now.Sub(time.Unix(0, last)).Seconds()
+		status.LastFragment = &age
+	}
+	switch {
+	case !status.Init:
+		status.Reason = "no init segment"
+	case status.LastFragment == nil:
+		status.Reason = "no fragment"
+	case *status.LastFragment > threshold.Seconds():
+		status.Reason = "stalled"
+	default:
+		status.Ready = true
+	}
+	return status
+}
+
+// status of every representation, sorted by id, and whether all of them are ready
+func healthStatus() ([]HealthStatus, bool) {
+	now := time.Now()
+	streams := allStreams()
+	statuses := make([]HealthStatus, 0, len(streams))
+	ready := len(streams) > 0
+	for _, stream := range streams {
+		status := stream.Health(now)
+		ready = ready && status.Ready
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Channel != statuses[j].Channel {
+			return statuses[i].Channel < statuses[j].Channel
+		}
+		return statuses[i].Representation < statuses[j].Representation
+	})
+	return statuses, ready
+}
+
+func writeHealth(w http.ResponseWriter, ok bool, statuses []HealthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(struct {
+		Status          string         `json:"status"`
+		Representations []HealthStatus `json:"representations"`
+	}{
+		Status:          map[bool]string{true: "ok", false: "unavailable"}[ok],
+		Representations: statuses,
+	})
+}
+
+// HealthzHandler is the liveness probe: the process is serving, whatever the state of the sources
+// (restarting the ingester does not bring an encoder back)
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	statuses, _ := healthStatus()
+	writeHealth(w, true, statuses)
+}
+
+// ReadyzHandler is the readiness probe: every representation has an init segment and a recent fragment
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	statuses, ready := healthStatus()
+	writeHealth(w, ready, statuses)
+}
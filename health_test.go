@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type healthResponse struct {
+	Status          string
+	Representations []HealthStatus
+}
+
+func getHealth(t *testing.T, handler http.HandlerFunc) (int, healthResponse) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	var health healthResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Cache-Control %q", w.Header().Get("Cache-Control"))
+	}
+	return w.Code, health
+}
+
+func TestHealthTransitions(t *testing.T) {
+	previousConfig, previousChannels := config.Load(), channels
+	t.Cleanup(func() {
+		config.Store(previousConfig)
+		channels = previousChannels
+	})
+	config.Store(&Config{})
+	stream := newTestStream(t, STORE_HEAP)
+	channels = []*Channel{stream.channel}
+
+	if status, health := getHealth(t, ReadyzHandler); status != http.StatusServiceUnavailable || len(health.Representations) != 0 {
+		t.Errorf("without representations: status %d, %+v", status, health)
+	}
+
+	stream.channel.streams = []*InputStream{stream}
+	ready := func(expected bool, reason string) HealthStatus {
+		t.Helper()
+		status, health := getHealth(t, ReadyzHandler)
+		if len(health.Representations) != 1 {
+			t.Fatalf("representations %+v", health.Representations)
+		}
+		representation := health.Representations[0]
+		if expected != (status == http.StatusOK) || expected != (health.Status == "ok") || representation.Ready != expected || representation.Reason != reason {
+			t.Errorf("readyz: status %d, %+v", status, health)
+		}
+		// the process stays live whatever the state of the source
+		if status, health := getHealth(t, HealthzHandler); status != http.StatusOK || health.Status != "ok" || len(health.Representations) != 1 {
+			t.Errorf("healthz: status %d, %+v", status, health)
+		}
+		return representation
+	}
+
+	if status := ready(false, "no init segment"); status.Channel != "test" || status.Representation != "v" || status.Init || status.LastFragment != nil {
+		t.Errorf("before the moov %+v", status)
+	}
+	stream.Ingest(bytes.NewReader(testInit()))
+	if status := ready(false, "no fragment"); !status.Init || status.LastFragment != nil {
+		t.Errorf("before the first fragment %+v", status)
+	}
+	stream.Ingest(bytes.NewReader(testSource(2, 2)))
+	if status := ready(true, ""); status.LastSequence != 2 || status.LastFragment == nil || *status.LastFragment > 1 {
+		t.Errorf("ingesting %+v", status)
+	}
+
+	// 5 fragment durations by default
+	stream.metrics.lastIngest.Store(time.Now().Add(-6 * time.Second).UnixNano())
+	if status := ready(false, "stalled"); status.LastFragment == nil || *status.LastFragment < 6 {
+		t.Errorf("stalled %+v", status)
+	}
+	config.Store(&Config{Server: Server{StallThreshold: 10000}})
+	ready(true, "")
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HLS_VERSION        = 6
+	HLS_PARTS_SEGMENTS = 2 // complete segments still advertising their parts, besides the one in progress
+)
+
+// MultivariantHandler lists every representation playlist with its bandwidth and resolution
+func (channel *Channel) MultivariantHandler(w http.ResponseWriter, r *http.Request) {
+	streams := channel.Streams()
+	ready := make([]*InputStream, 0, len(streams))
+	for _, stream := range streams {
+		if stream.moov != nil && stream.timescale != 0 {
+			ready = append(ready, stream)
+		}
+	}
+	if len(ready) == 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	sort.Slice(ready, func(i, j int) bool { return ready[i].repr.Id < ready[j].repr.Id })
+
+	credentials := authQuery(r)
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-INDEPENDENT-SEGMENTS\n", HLS_VERSION)
+
+	// audio representations are renditions of a single group, every video variant refers to it
+	variants := make([]*InputStream, 0, len(ready))
+	audioPeak, audioAverage, audioCodecs := uint64(0), uint64(0), ""
+	for _, stream := range ready {
+		if stream.repr.Type != AUDIO {
+			variants = append(variants, stream)
+			continue
+		}
+		fmt.Fprintf(&b, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"%s\",DEFAULT=%s,AUTOSELECT=YES,CHANNELS=\"%d\",URI=\"%s/playlist.m3u8%s\"\n",
+			stream.repr.Id, hlsBool(audioPeak == 0), stream.repr.Channels, stream.repr.Id, credentials)
+		audioPeak = max(audioPeak, stream.PeakBandwidth())
+		audioAverage = max(audioAverage, stream.Bandwidth())
+		if audioCodecs == "" {
+			audioCodecs = stream.repr.Codecs
+		}
+	}
+	if len(variants) == 0 {
+		// audio only ladder
+		variants, audioPeak, audioAverage, audioCodecs = ready, 0, 0, ""
+	}
+
+	for _, stream := range variants {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d", stream.PeakBandwidth()+audioPeak, stream.Bandwidth()+audioAverage)
+		codecs := stream.repr.Codecs
+		if audioCodecs != "" {
+			codecs += "," + audioCodecs
+		}
+		fmt.Fprintf(&b, ",CODECS=\"%s\"", codecs)
+		if stream.repr.Width != 0 && stream.repr.Height != 0 {
+			fmt.Fprintf(&b, ",RESOLUTION=%dx%d", stream.repr.Width, stream.repr.Height)
+		}
+		if stream.repr.FrameRate > 0 {
+			fmt.Fprintf(&b, ",FRAME-RATE=%.3f", stream.repr.FrameRate)
+		}
+		if audioPeak > 0 {
+			fmt.Fprintf(&b, ",AUDIO=\"audio\"")
+		}
+		fmt.Fprintf(&b, "\n%s/playlist.m3u8%s\n", stream.repr.Id, credentials)
+	}
+
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, b.String())
+}
+
+// ServePlaylist writes the LL-HLS media playlist, holding the request when _HLS_msn/_HLS_part ask for the future
+func (stream *InputStream) ServePlaylist(w http.ResponseWriter, r *http.Request) {
+	partTarget := float64(stream.channel.ingester().FragmentDuration) / 1000
+	targetDuration := stream.targetDuration()
+
+	if query := r.URL.Query(); query.Has("_HLS_msn") {
+		msn, err := strconv.ParseUint(query.Get("_HLS_msn"), 10, 64)
+		part, errPart := int64(-1), error(nil)
+		if query.Has("_HLS_part") {
+			part, errPart = strconv.ParseInt(query.Get("_HLS_part"), 10, 64)
+		}
+		if err != nil || errPart != nil || part < -1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if last := stream.lastKeyframe(); last != nil && msn > last.msn+2 {
+			// too far in the future, the client is confused
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		timeout := time.Duration(3 * targetDuration * float64(time.Second))
+		if !stream.WaitUntil(r.Context(), timeout, func() bool { return stream.hasPart(msn, part) }) {
+			w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	keyframes := stream.DvrKeyframes()
+	head := stream.headSequence()
+	if len(keyframes) == 0 {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+
+	discontinuitySequence := 0
+	for _, seq := range stream.discontinuities {
+		if seq < keyframes[0].Sequence {
+			discontinuitySequence++
+		}
+	}
+
+	credentials := authQuery(r)
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:%d\n", HLS_VERSION)
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(targetDuration)))
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget)
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", keyframes[0].msn)
+	fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discontinuitySequence)
+	// every init segment is a generation, segments after an encoder restart refer to a new one
+	generation := keyframes[0].generation
+	fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init-%d.mp4%s\"\n", generation, credentials)
+
+	for i, keyframe := range keyframes {
+		if keyframe.Sequence > head {
+			break
+		}
+		for _, seq := range stream.discontinuities {
+			if seq == keyframe.Sequence {
+				fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY\n")
+			}
+		}
+		if keyframe.generation != generation {
+			generation = keyframe.generation
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init-%d.mp4%s\"\n", generation, credentials)
+		}
+		fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", stream.wallClock(keyframe.Pts, keyframe.Timescale).UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+
+		complete := i+1 < len(keyframes) && keyframes[i+1].Sequence <= head
+		last := head
+		if complete {
+			last = keyframes[i+1].Sequence - 1
+		}
+		if i >= len(keyframes)-1-HLS_PARTS_SEGMENTS {
+			for seq := keyframe.Sequence; seq <= last; seq++ {
+				if part := stream.GetCompleteFragment(seq); part != nil {
+					fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%.3f,URI=\"part/%d%s\"", stream.partDuration(part), seq, credentials)
+					if part.Keyframe {
+						fmt.Fprintf(&b, ",INDEPENDENT=YES")
+					}
+					fmt.Fprintf(&b, "\n")
+				}
+			}
+		}
+		if complete {
+			fmt.Fprintf(&b, "#EXTINF:%.3f,\n%d%s\n", stream.segmentSeconds(keyframes, i), keyframe.Sequence, credentials)
+		}
+	}
+	fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part/%d%s\"\n", head+1, credentials)
+
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, b.String())
+}
+
+// ServePart writes a single fragment, waiting for it when it is the one being produced (preload hint)
+func (stream *InputStream) ServePart(w http.ResponseWriter, r *http.Request, seq uint32) {
+	part := stream.GetCompleteFragment(seq)
+	if part == nil && seq > stream.headSequence() && seq <= stream.headSequence()+2 {
+		timeout := time.Duration(3 * float64(stream.channel.ingester().FragmentDuration) * float64(time.Millisecond))
+		stream.WaitUntil(r.Context(), timeout, func() bool {
+			part = stream.GetCompleteFragment(seq)
+			return part != nil
+		})
+	}
+	if part == nil {
+		w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Part %d not found", seq)
+		return
+	}
+
+	w.Header().Set("Ruddr-Pts", fmt.Sprintf("%d", part.Pts))
+	w.Header().Set("Ruddr-Timescale", fmt.Sprintf("%d", part.Timescale))
+	config.Load().Auth.cacheControl(w, "max-age=180")
+	w.Header().Set("Access-Control-Expose-Headers", "ruddr-pts, ruddr-timescale")
+	w.Header().Set("ETag", fragmentsETag([]*Fragment{part}))
+	stream.serveFile(w, r, []FragmentData{part.data})
+}
+
+// true once the playlist contains the given part of the given segment (part -1 means the whole segment)
+func (stream *InputStream) hasPart(msn uint64, part int64) bool {
+	last := stream.lastKeyframe()
+	if last == nil {
+		return false
+	}
+	if msn < last.msn {
+		return true
+	}
+	if msn > last.msn || part < 0 {
+		return false
+	}
+	return int64(stream.headSequence())-int64(last.Sequence) >= part
+}
+
+// sequence number of the latest fragment whose mdat was received
+func (stream *InputStream) headSequence() uint32 {
+	head := stream.lastSeqNumber.Load()
+	if stream.GetCompleteFragment(head) == nil && head > 0 {
+		head--
+	}
+	return head
+}
+
+func (stream *InputStream) lastKeyframe() *Fragment {
+	keyframes := stream.windowKeyframes()
+	if len(keyframes) == 0 {
+		return nil
+	}
+	return keyframes[len(keyframes)-1]
+}
+
+// longest segment in the window, never shorter than the nominal fragment duration
+func (stream *InputStream) targetDuration() float64 {
+	target := float64(stream.channel.ingester().FragmentDuration) / 1000
+	keyframes := stream.windowKeyframes()
+	for i := 0; i+1 < len(keyframes); i++ {
+		target = math.Max(target, stream.segmentSeconds(keyframes, i))
+	}
+	return target
+}
+
+// end of the segment opened by keyframes[i] in its timescale: the next keyframe, or the end of its last fragment
+// when the next keyframe starts a discontinuity, the time jumped over an outage is not media
+func (stream *InputStream) segmentEnd(keyframes []*Fragment, i int) uint64 {
+	keyframe, next := keyframes[i], keyframes[i+1]
+	if keyframe.segmentEnd > keyframe.Pts && slices.Contains(stream.discontinuities, next.Sequence) {
+		return keyframe.segmentEnd
+	}
+	return max(keyframe.Pts, Rescale(next.Pts, next.Timescale, keyframe.Timescale))
+}
+
+func (stream *InputStream) segmentSeconds(keyframes []*Fragment, i int) float64 {
+	return float64(stream.segmentEnd(keyframes, i)-keyframes[i].Pts) / float64(keyframes[i].Timescale)
+}
+
+func (stream *InputStream) partDuration(part *Fragment) float64 {
+	if part.Duration > 0 {
+		return part.EndSeconds() - part.Seconds()
+	}
+	return float64(stream.channel.ingester().FragmentDuration) / 1000
+}
+
+func hlsBool(b bool) string {
+	if b {
+		return "YES"
+	}
+	return "NO"
+}
+
+// highest bitrate among the complete segments of the keyframes window
+func (stream *InputStream) PeakBandwidth() uint64 {
+	peak := uint64(0)
+	keyframes := stream.windowKeyframes()
+	for i := 0; i+1 < len(keyframes); i++ {
+		duration := stream.segmentSeconds(keyframes, i)
+		if duration <= 0 {
+			continue
+		}
+		bytes := uint64(0)
+		for seq := keyframes[i].Sequence; seq < keyframes[i+1].Sequence; seq++ {
+			if frag, ok := stream.fragments.Get(seq); ok {
+				bytes += uint64(frag.ByteLength)
+			}
+		}
+		peak = max(peak, uint64(float64(bytes*8)/duration))
+	}
+	return max(peak, stream.Bandwidth())
+}
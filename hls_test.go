@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlockingPlaylist(t *testing.T) {
+	_, server, feed := newLiveTestServer(t)
+	feed(1, 2, 3, 4)
+	get := func(query string) (int, string) {
+		response, err := http.Get(server.URL + "/test/v/playlist.m3u8?" + query)
+		if err != nil {
+			t.Error(err)
+			return 0, ""
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return response.StatusCode, string(body)
+	}
+	type result struct {
+		status   int
+		playlist string
+	}
+	held := func(query string) <-chan result {
+		results := make(chan result, 1)
+		go func() {
+			status, playlist := get(query)
+			results <- result{status, playlist}
+		}()
+		select {
+		case r := <-results:
+			t.Fatalf("%s answered %d before the part was produced", query, r.status)
+		case <-time.After(100 * time.Millisecond):
+		}
+		return results
+	}
+
+	// the parts of the segment of fragment 3 (msn 1) are there already
+	if status, playlist := get("_HLS_msn=1&_HLS_part=1"); status != http.StatusOK || !strings.Contains(playlist, `URI="part/4"`) {
+		t.Errorf("existing part: status %d\n%s", status, playlist)
+	}
+	// the keyframe of fragment 5 starts msn 2
+	results := held("_HLS_msn=2&_HLS_part=0")
+	feed(5)
+	if r := <-results; r.status != http.StatusOK || !strings.Contains(r.playlist, `#EXT-X-PART:DURATION=1.000,URI="part/5",INDEPENDENT=YES`) || !strings.Contains(r.playlist, "\n3\n") {
+		t.Errorf("held for part 0 of msn 2: status %d\n%s", r.status, r.playlist)
+	}
+	results = held("_HLS_msn=2&_HLS_part=1")
+	feed(6)
+	if r := <-results; r.status != http.StatusOK || !strings.Contains(r.playlist, `URI="part/6"`) || !strings.Contains(r.playlist, `#EXT-X-PRELOAD-HINT:TYPE=PART,URI="part/7"`) {
+		t.Errorf("held for part 1 of msn 2: status %d\n%s", r.status, r.playlist)
+	}
+
+	for _, query := range []string{"_HLS_msn=10", "_HLS_msn=2&_HLS_part=-2", "_HLS_msn=x", "_HLS_msn=2&_HLS_part=x"} {
+		if status, _ := get(query); status != http.StatusBadRequest {
+			t.Errorf("%s: status %d", query, status)
+		}
+	}
+}
@@ -1,129 +1,248 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"math" // just for logging
+	"log/slog"
+	"math"
+	"math/bits"
+	"os"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
-
-	"github.com/justincormack/go-memfd"
 )
 
 type Fragment struct {
 	moof       []byte       `json:"-"`
-	fd         *memfd.Memfd `json:"-"`
+	data       FragmentData `json:"-"` // moof + mdat, nil until the mdat arrives
 	ByteLength uint32       `json:"size"`
 	Sequence   uint32       `json:"seq"`
-	Pts        float32      `json:"pts"`
+	Pts        uint64       `json:"pts"` // decode time, in timescale units
+	Timescale  uint32       `json:"timescale"`
+	Duration   uint64       `json:"-"` // in timescale units
 	Keyframe   bool         `json:"-"`
 	IFrameSize uint32       `json:"iframe"`
+	msn        uint64       // media sequence number of the segment opened by this keyframe
+	generation uint32       // init segment the fragment refers to
+	segmentEnd uint64       // keyframes only: end of the last complete fragment of their segment
+	ingested   time.Time    // when its mdat was received, the fragment became available
+}
+
+// an init segment and the start of the timeline of the fragments referring to it
+type initSegment struct {
+	moov      []byte
+	pts       uint64 // presentation time of the first fragment on the continuous timeline
+	tfdt      uint64 // its decode time in the source
+	timescale uint32 // 0 until the first fragment is received
 }
 
 type InputStream struct {
 	repr            *Representation
-	fragments       sync.Map
-	lastSeqNumber   uint32
+	channel         *Channel
+	fragments       FragmentStore
+	lastSeqNumber   atomic.Uint32 // written by the ingest, read by the requests waiting for the next fragments
 	timescale       uint32
+	codec           string // sample entry fourcc, selects the keyframe parser
 	moov            []byte
-	timestamp       time.Time
+	inits           sync.Map      // generation -> *initSegment, for the generations still in the window
+	timestamp       time.Time     // wall clock time at which the first fragment started
+	origin          time.Duration // presentation time of the first fragment on the continuous timeline
 	fragmentsWindow *CircularBuffer[Fragment]
-	keyframes       []*Fragment // so that you do not traverse the sync.Map at every Manifest request (locking)
+	keyframes       []*Fragment  // so that you do not traverse the sync.Map at every Manifest request (locking)
+	keyframesMu     sync.RWMutex // guards the keyframes slice, its elements are never written once appended
+	ingesting       atomic.Bool  // only one source at a time can feed the parser
+	parsing         sync.Mutex   // held while a source is parsed, Stop waits on it
+	ctx             context.Context
+	cancel          context.CancelFunc // stops the stream, see Stop
+	stopPipe        context.CancelFunc // stops the pipe supervisor, nil without a pipe
+	events          chan<- Event
+	discontinuity   bool     // next fragment starts a new timeline (encoder restart, lost data)
+	discontinuities []uint32 // sequence numbers of the first fragment after each discontinuity
+	seqOffset       uint32   // keeps sequence numbers increasing across encoder restarts
+	ptsOffset       uint64   // keeps presentation times increasing across encoder restarts, in stream timescale
+	keyframeCount   uint64   // keyframes ever received, numbers the segments
+	notifyMu        sync.Mutex
+	notify          chan struct{}  // closed and replaced every time a fragment is completed
+	generation      uint32         // init segments received
+	archive         *StreamArchive // disk tier of the evicted fragments, nil when disabled
+	metrics         StreamMetrics
+	log             *slog.Logger
+	logLevel        slog.LevelVar // changed at runtime through the admin API
+}
+
+const (
+	MAX_ATOM_SIZE      = 64 << 20 // anything bigger is considered garbage from the source
+	ATOM_PREALLOCATION = 1 << 20  // of the atom data buffer, bigger atoms grow it while being read
+	PIPE_RETRY_DELAY   = time.Second
+)
+
+var (
+	ErrIngestBusy    = errors.New("representation is already being ingested")
+	ErrStreamStopped = errors.New("representation was removed")
+)
+
+// top level boxes a fragmented MP4 source is expected to produce, used to find the next box boundary
+var topLevelAtoms = map[string]bool{
+	"ftyp": true, "styp": true, "moov": true, "moof": true, "mdat": true,
+	"free": true, "skip": true, "sidx": true, "prft": true, "emsg": true, "mfra": true,
+}
+
+// Supervise keeps the pipe ingested, reopening it after any failure so that a restarted encoder is picked up again
+// it returns once ctx is done, closing the pipe being read
+func (stream *InputStream) Supervise(ctx context.Context, pipe string) {
+	for ctx.Err() == nil {
+		namedPipe, err := os.OpenFile(pipe, syscall.O_RDWR|syscall.O_NONBLOCK, os.ModeNamedPipe)
+		if err != nil {
+			stream.log.Error("opening pipe", "pipe", pipe, "error", err)
+			sleep(ctx, PIPE_RETRY_DELAY)
+			continue
+		}
+		stop := context.AfterFunc(ctx, func() { namedPipe.Close() })
+		err = stream.Ingest(namedPipe)
+		stop()
+		namedPipe.Close()
+		stream.log.Warn("pipe closed", "pipe", pipe, "error", err)
+		sleep(ctx, PIPE_RETRY_DELAY)
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
 }
 
-func (stream *InputStream) Parse(data io.Reader) {
+// Ingest parses data as the only source of the stream, the source being replaced is a discontinuity
+func (stream *InputStream) Ingest(data io.Reader) error {
+	if !stream.ingesting.CompareAndSwap(false, true) {
+		return ErrIngestBusy
+	}
+	defer stream.ingesting.Store(false)
+	stream.parsing.Lock()
+	defer stream.parsing.Unlock()
+	if stream.ctx.Err() != nil {
+		return ErrStreamStopped
+	}
+	err := stream.Parse(data)
+	stream.discontinuity = true
+	return err
+}
+
+// Parse reads atoms until the source fails, skipping garbage up to the next valid box boundary
+func (stream *InputStream) Parse(source io.Reader) error {
+	data := bufio.NewReader(source)
 	// Each MP4 Fragment must start with MP4 header 4B + 4B
 	atomHeader := make([]byte, 8)
 	for {
 		if _, err := io.ReadFull(data, atomHeader); err != nil {
-			fmt.Println(stream.repr.Id, "# Error reading atom header:", err)
-			return
+			return fmt.Errorf("reading atom header: %w", err)
 		}
-		atomSize := binary.BigEndian.Uint32(atomHeader[:4])
+		atomSize := uint64(binary.BigEndian.Uint32(atomHeader[:4]))
 		atomType := string(atomHeader[4:8])
+		headerSize := uint64(8)
+		header := atomHeader
+		// 64 bit largesize follows the type
+		if atomSize == 1 && isAtomType(atomHeader[4:8]) {
+			largeSize := make([]byte, 8)
+			if _, err := io.ReadFull(data, largeSize); err != nil {
+				return fmt.Errorf("reading atom %s largesize: %w", atomType, err)
+			}
+			atomSize = binary.BigEndian.Uint64(largeSize)
+			headerSize = 16
+			header = append(atomHeader[:8:8], largeSize...)
+		}
 		// by specs, atom size includes header, hence each atom is minimum 8 Bytes
-		if atomSize < 8 {
-			fmt.Println(stream.repr.Id, "# Invalid atom", atomSize, atomType)
-			return
+		// size 0 (up to the end of the file) has no meaning on a live source
+		if atomSize < headerSize || atomSize > MAX_ATOM_SIZE || !isAtomType(atomHeader[4:8]) {
+			stream.log.Warn("invalid atom, resynchronizing", "size", atomSize, "type", fmt.Sprintf("%q", atomType))
+			skipped, err := resync(data)
+			if err != nil {
+				return fmt.Errorf("resynchronizing after %d bytes: %w", skipped, err)
+			}
+			stream.log.Info("resynchronized", "skipped_bytes", skipped+8)
+			stream.discontinuity = true
+			continue
 		}
-		atomData := make([]byte, atomSize-8)
-		if _, err := io.ReadFull(data, atomData); err != nil {
-			fmt.Println(stream.repr.Id, "# Error reading atom data:", err)
-			return
+		atomData, err := readAtomData(data, atomSize-headerSize)
+		if err != nil {
+			return fmt.Errorf("reading atom %s data: %w", atomType, err)
 		}
 
 		if atomType != "mdat" && atomType != "moof" && atomType != "moov" {
 			continue
 		}
-		fullAtom := append(atomHeader, atomData...) // new slice with full atom
+		fullAtom := append(header, atomData...) // new slice with full atom
 
 		switch atomType {
 		case "moov":
-			stream.moov = fullAtom // TODO: assert, is this a copy?
-			stream.timestamp = time.Now()
-
-			parser := NewMP4Parser(stream.moov, nil)
-			stream.repr.Width, stream.repr.Height = parser.GetResolution()
-			stream.timescale = parser.GetVideoTimescale()
-
-			fmt.Println(stream.repr.Id, "# Received moov atom at", stream.timestamp, "with resolution", stream.repr.Width, "x", stream.repr.Height, "and timescale", stream.timescale)
+			if err := stream.parseInit(fullAtom); err != nil {
+				stream.log.Warn("discarding invalid moov atom", "error", err)
+			}
 			break
 
 		case "moof":
-			p := NewMP4Parser(stream.moov, fullAtom)
-			pts := p.GetPTS(stream.timescale)
-			seq := p.GetSequenceNumber()
-
-			frag := &Fragment{
-				moof:       fullAtom, // underlying data in slices is always passed by reference
-				ByteLength: uint32(atomSize),
-				Sequence:   seq,
-				Pts:        pts,
-				Keyframe:   p.IsIFrame(),
+			frag, err := stream.parseFragment(fullAtom)
+			if err != nil {
+				// its mdat will find the previous fragment already complete and will be dropped too
+				stream.log.Warn("discarding invalid moof atom", "error", err)
+				stream.discontinuity = true
+				break
 			}
 
-			stream.lastSeqNumber = seq
-			stream.fragments.Store(seq, frag)
+			stream.lastSeqNumber.Store(frag.Sequence)
+			stream.fragments.Put(frag)
 
 			break
 
 		case "mdat":
-			if fragment, ok := stream.fragments.Load(stream.lastSeqNumber); ok { // handles synchronization and semaphores internally
-				// `interface{}` to Concrete Type `*Fragment`
-				fragment.(*Fragment).ByteLength += atomSize
-
-				file, _ := memfd.Create()
-				file.Write(fragment.(*Fragment).moof)
-				file.Write(fullAtom)
-				file.SetImmutable()
-				file.Seek(0, io.SeekStart)
-				file.SetSize(int64(fragment.(*Fragment).ByteLength))
-				fragment.(*Fragment).fd = file
-
-				pts := (fragment.(*Fragment).Pts)
+			// an mdat whose moof was lost (resync) has nothing to be attached to
+			if fragment, ok := stream.fragments.Get(stream.lastSeqNumber.Load()); ok && fragment.data == nil {
+				fragment.ByteLength += uint32(atomSize)
+				if err := stream.fragments.Write(fragment, fullAtom); err != nil {
+					stream.log.Error("storing fragment", "seq", fragment.Sequence, "error", err)
+					fragment.ByteLength -= uint32(atomSize)
+					stream.discontinuity = true
+					break
+				}
+				fragment.ingested = time.Now()
+				stream.metrics.ingested(fragment)
+
+				pts := fragment.Seconds()
 				isIFrame := "X"
-				if fragment.(*Fragment).Keyframe {
-					fragment.(*Fragment).IFrameSize = GetIFrameSize(fullAtom) // look inside NAL only if sample keyframe
+				if fragment.Keyframe {
+					if stream.repr.Type == AUDIO {
+						fragment.IFrameSize = uint32(atomSize - headerSize) // the whole payload is decodable on its own
+					} else {
+						fragment.IFrameSize = GetKeyframeSize(stream.codec, fullAtom) // look inside NAL only if sample keyframe
+					}
 					isIFrame = "I"
-					stream.AddKeyframe(fragment.(*Fragment))
-					if len(stream.keyframes) > 1 && stream.lastSeqNumber > config.Ingester.HeapSize && stream.keyframes[0].Sequence < (stream.lastSeqNumber-config.Ingester.HeapSize) {
-						deleteOlder(
-							&stream.fragments,
-							stream.keyframes[1].Sequence-1,
-							func(v interface{}) {
-								v.(*Fragment).fd.Unmap()
-								v.(*Fragment).fd.Close()
-							},
-						)
+					stream.AddKeyframe(fragment)
+					// a segment is evicted whole and its keyframe along with it, both windows hold HeapSize fragments
+					for len(stream.keyframes) > 1 && stream.lastSeqNumber.Load() > stream.channel.ingester().HeapSize && stream.keyframes[0].Sequence < (stream.lastSeqNumber.Load()-stream.channel.ingester().HeapSize) {
+						stream.evict(stream.fragments.Evict(stream.keyframes[1].Sequence - 1))
+						// the requests may still hold the previous slice, appends only write past its end
+						stream.keyframesMu.Lock()
+						stream.keyframes = stream.keyframes[1:]
+						stream.keyframesMu.Unlock()
 					}
 				}
 
-				if stream.repr.Log == true {
-					fmt.Printf("%s - Repr %s\tFrag %d\tPTS %02d:%02d\tSize %d\n", isIFrame, stream.repr.Id, fragment.(*Fragment).Sequence, int(pts/60), int(math.Mod(float64(pts), 60)), fragment.(*Fragment).ByteLength)
+				if last := stream.lastKeyframe(); last != nil && fragment.Sequence >= last.Sequence {
+					last.segmentEnd = Rescale(fragment.Pts+fragment.Duration, fragment.Timescale, last.Timescale)
 				}
 
-				stream.fragmentsWindow.Add(fragment.(*Fragment))
+				stream.log.Debug("fragment", "type", isIFrame, "seq", fragment.Sequence, "pts", fmt.Sprintf("%02d:%02d", int(pts/60), int(math.Mod(float64(pts), 60))), "size", fragment.ByteLength)
+
+				stream.fragmentsWindow.Add(fragment)
+				stream.publish()
 			}
 			break
 		default:
@@ -131,12 +250,255 @@ func (stream *InputStream) Parse(data io.Reader) {
 	}
 }
 
+// reads the stream properties from a new init segment, the previous one is kept if this is not valid
+func (stream *InputStream) parseInit(moov []byte) error {
+	parser := NewMP4Parser(moov, nil)
+	handlerType, err := parser.GetHandlerType()
+	if err != nil {
+		return err
+	}
+	timescale, err := parser.GetTimescale(handlerType)
+	if err != nil {
+		return err
+	}
+	codec, err := parser.GetCodec()
+	if err != nil {
+		return err
+	}
+	codecs, err := parser.GetCodecString()
+	if err != nil {
+		return err
+	}
+
+	// a new init segment after media means the encoder restarted
+	if stream.GetLastFragment() != nil {
+		stream.discontinuity = true
+	}
+	stream.moov = moov // TODO: assert, is this a copy?
+	stream.generation++
+	stream.inits.Store(stream.generation, &initSegment{moov: moov})
+	if keyframes := stream.DvrKeyframes(); len(keyframes) > 0 {
+		// segments of older generations are gone, their init segments cannot be requested anymore
+		stream.inits.Range(func(generation, _ any) bool {
+			if generation.(uint32) < keyframes[0].generation {
+				stream.inits.Delete(generation)
+			}
+			return true
+		})
+	}
+	if stream.archive != nil {
+		if err := stream.archive.StoreInit(stream.generation, moov); err != nil {
+			stream.log.Error("archiving moov", "error", err)
+		}
+	}
+	stream.timescale = timescale
+	stream.codec = codec
+	stream.repr.Codecs = codecs
+	stream.repr.FrameRate = 0 // measured again on the first fragment
+
+	if handlerType == "soun" {
+		stream.repr.Type = AUDIO
+		if stream.repr.SampleRate, stream.repr.Channels, stream.repr.Bitrate, err = parser.GetAudioInfo(); err != nil {
+			stream.log.Warn("audio sample entry not readable", "error", err)
+		}
+
+		stream.log.Info("received moov atom", "codecs", stream.repr.Codecs, "sample_rate", stream.repr.SampleRate, "channels", stream.repr.Channels, "timescale", stream.timescale)
+		return nil
+	}
+	stream.repr.Type = VIDEO
+	if stream.repr.Width, stream.repr.Height, err = parser.GetResolution(); err != nil {
+		stream.log.Warn("resolution not readable", "error", err)
+	}
+	parW, parH := parser.GetPixelAspectRatio()
+	stream.repr.Sar = fmt.Sprintf("%d:%d", parW, parH)
+	stream.repr.Color = parser.GetColorInfo()
+
+	stream.log.Info("received moov atom", "codecs", stream.repr.Codecs, "width", stream.repr.Width, "height", stream.repr.Height, "timescale", stream.timescale)
+	return nil
+}
+
+var ErrNoInit = errors.New("fragment received before any init segment")
+
+// builds the fragment from its moof, placing it on the stream timeline
+func (stream *InputStream) parseFragment(moof []byte) (*Fragment, error) {
+	if stream.moov == nil || stream.timescale == 0 {
+		return nil, ErrNoInit
+	}
+	p := NewMP4Parser(stream.moov, moof)
+	pts, err := p.GetDecodeTime()
+	if err != nil {
+		return nil, err
+	}
+	seq, err := p.GetSequenceNumber()
+	if err != nil {
+		return nil, err
+	}
+	duration, err := p.GetDuration()
+	if err != nil {
+		return nil, err
+	}
+	keyframe, err := p.IsIFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	if stream.discontinuity {
+		stream.startDiscontinuity(seq, pts, duration)
+	}
+	seq += stream.seqOffset
+	tfdt := pts
+	pts += stream.ptsOffset
+
+	if stream.timestamp.IsZero() {
+		// received once complete, it started a fragment duration ago
+		stream.timestamp = time.Now().Add(-time.Duration(Rescale(duration, stream.timescale, uint32(time.Second))))
+		stream.origin = time.Duration(Rescale(pts, stream.timescale, uint32(time.Second)))
+		stream.log.Info("timeline started", "start", stream.timestamp, "pts", pts)
+	}
+	if init := stream.init(stream.generation); init != nil && init.timescale == 0 {
+		stream.inits.Store(stream.generation, &initSegment{moov: init.moov, pts: pts, tfdt: tfdt, timescale: stream.timescale})
+	}
+
+	frag := &Fragment{
+		moof:       moof, // underlying data in slices is always passed by reference
+		ByteLength: uint32(len(moof)),
+		Sequence:   seq,
+		Pts:        pts,
+		Timescale:  stream.timescale,
+		Duration:   duration,
+		Keyframe:   stream.repr.Type == AUDIO || keyframe, // every audio fragment is a sync point
+		generation: stream.generation,
+	}
+
+	// the init segment of a fragmented MP4 has no samples, the frame rate comes from the first fragment
+	if stream.repr.Type == VIDEO && stream.repr.FrameRate == 0 && frag.Duration > 0 {
+		if samples, err := p.GetSampleCount(); err == nil {
+			stream.repr.FrameRate = float32(math.Round(float64(samples)*float64(frag.Timescale)/float64(frag.Duration)*1000) / 1000)
+		}
+	}
+	return frag, nil
+}
+
+// shifts the new timeline after the previous one and records where it starts, the first fragment being
+// placed where it started on the wall clock when the source was away for longer than a fragment
+func (stream *InputStream) startDiscontinuity(seq uint32, pts uint64, duration uint64) {
+	stream.discontinuity = false
+
+	last := stream.GetLastFragment()
+	if last == nil {
+		return
+	}
+	next := last.Sequence + 1
+	// the previous timeline may use another timescale
+	nextPts := Rescale(last.Pts+last.Duration, last.Timescale, stream.timescale)
+	if last.Duration == 0 {
+		nextPts += uint64(stream.channel.ingester().FragmentDuration) * uint64(stream.timescale) / 1000
+	}
+	if last.data == nil {
+		// the moof whose mdat never arrived cannot be served, its slot is taken by the new timeline
+		stream.fragments.Delete(last.Sequence)
+		next = last.Sequence
+		nextPts = Rescale(last.Pts, last.Timescale, stream.timescale)
+	}
+	// the outage lasted on the wall clock too, AST + t (DASH) and PROGRAM-DATE-TIME (HLS) must not trail it
+	fragment := uint64(stream.channel.ingester().FragmentDuration) * uint64(stream.timescale) / 1000
+	if wallPts := stream.mediaTime(time.Now()); wallPts > nextPts+duration+fragment {
+		nextPts = wallPts - duration
+	}
+	if seq+stream.seqOffset < next {
+		stream.seqOffset = next - seq
+	}
+	if pts+stream.ptsOffset < nextPts {
+		stream.ptsOffset = nextPts - pts
+	}
+	stream.discontinuities = append(stream.discontinuities, seq+stream.seqOffset)
+	stream.log.Warn("discontinuity", "seq", seq+stream.seqOffset)
+
+	data, err := json.Marshal(struct {
+		Representation string `json:"representation"`
+		Seq            uint32 `json:"seq"`
+		Pts            uint64 `json:"pts"`
+		Timescale      uint32 `json:"timescale"`
+	}{
+		Representation: stream.repr.Id,
+		Seq:            seq + stream.seqOffset,
+		Pts:            pts + stream.ptsOffset,
+		Timescale:      stream.timescale,
+	})
+	if err != nil || stream.events == nil {
+		return
+	}
+	// never stall the ingest on SSE delivery
+	select {
+	case stream.events <- Event{Name: "discontinuity", Data: data}:
+	default:
+		stream.log.Warn("dropping discontinuity event, broadcaster busy")
+	}
+}
+
+// position of the wall clock time t on the continuous timeline, in stream timescale
+func (stream *InputStream) mediaTime(t time.Time) uint64 {
+	elapsed := t.Sub(stream.timestamp) + stream.origin
+	if stream.timestamp.IsZero() || elapsed < 0 {
+		return 0
+	}
+	return Rescale(uint64(elapsed), uint32(time.Second), stream.timescale)
+}
+
+// wall clock time of a presentation time on the continuous timeline
+func (stream *InputStream) wallClock(pts uint64, timescale uint32) time.Time {
+	return stream.timestamp.Add(time.Duration(Rescale(pts, timescale, uint32(time.Second))) - stream.origin)
+}
+
+// a box type is made of four printable characters
+func isAtomType(b []byte) bool {
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// reads size bytes, the buffer grows as they arrive so that a corrupted size does not allocate MAX_ATOM_SIZE upfront
+func readAtomData(data io.Reader, size uint64) ([]byte, error) {
+	atomData := make([]byte, 0, min(size, ATOM_PREALLOCATION))
+	for uint64(len(atomData)) < size {
+		if len(atomData) == cap(atomData) {
+			atomData = slices.Grow(atomData, int(min(size-uint64(len(atomData)), uint64(len(atomData)))))
+		}
+		n, err := io.ReadFull(data, atomData[len(atomData):min(uint64(cap(atomData)), size)])
+		atomData = atomData[:len(atomData)+n]
+		if err != nil {
+			return atomData, err
+		}
+	}
+	return atomData, nil
+}
+
+// discards bytes until the reader is positioned on a plausible top level box header
+func resync(data *bufio.Reader) (int, error) {
+	skipped := 0
+	for {
+		header, err := data.Peek(8)
+		if err != nil {
+			return skipped, err
+		}
+		size := binary.BigEndian.Uint32(header[:4])
+		if topLevelAtoms[string(header[4:8])] && size >= 8 && size <= MAX_ATOM_SIZE {
+			return skipped, nil
+		}
+		data.Discard(1)
+		skipped++
+	}
+}
+
 func (stream *InputStream) GetPlayableFragment(index uint32) (*Fragment, int) {
 	currentKey := index
 	for {
-		if val, ok := stream.fragments.Load(currentKey); ok {
-			if val.(*Fragment).Keyframe == true {
-				return val.(*Fragment), int(currentKey)
+		if frag, ok := stream.fragments.Get(currentKey); ok {
+			if frag.Keyframe == true {
+				return frag, int(currentKey)
 			}
 		} else {
 			return nil, 0
@@ -146,8 +508,8 @@ func (stream *InputStream) GetPlayableFragment(index uint32) (*Fragment, int) {
 }
 
 func (stream *InputStream) GetLastFragment() *Fragment {
-	if val, ok := stream.fragments.Load(stream.lastSeqNumber); ok {
-		return val.(*Fragment)
+	if frag, ok := stream.fragments.Get(stream.lastSeqNumber.Load()); ok {
+		return frag
 	}
 	return nil
 }
@@ -158,11 +520,11 @@ func (stream *InputStream) GetNextFragments(keyframe *Fragment) ([]*Fragment, in
 	var fragments []*Fragment
 	currentKey := keyframe.Sequence + 1
 	for {
-		if val, ok := stream.fragments.Load(currentKey); ok {
-			if val.(*Fragment).Keyframe == true {
+		if frag, ok := stream.fragments.Get(currentKey); ok {
+			if frag.Keyframe == true {
 				break
 			}
-			fragments = append(fragments, val.(*Fragment))
+			fragments = append(fragments, frag)
 		} else {
 			return nil, 0
 		}
@@ -171,35 +533,173 @@ func (stream *InputStream) GetNextFragments(keyframe *Fragment) ([]*Fragment, in
 	return append([]*Fragment{keyframe}, fragments...), len(fragments) + 1 // include the keyframe
 }
 
-// method to add a keyframe fragment to the array and that trims the array if PTS is too old
+// finds the keyframe of the given generation starting at decode time t, as listed by the DASH SegmentTimeline
+func (stream *InputStream) GetKeyframeAt(generation uint32, t uint64) *Fragment {
+	init := stream.init(generation)
+	if init == nil || init.timescale == 0 {
+		return nil
+	}
+	for _, keyframe := range stream.DvrKeyframes() {
+		if keyframe.generation == generation && keyframe.Pts-init.pts+init.tfdt == t {
+			return keyframe
+		}
+	}
+	return nil
+}
+
+// presentation time in seconds, for logging and durations only
+func (frag *Fragment) Seconds() float64 {
+	return float64(frag.Pts) / float64(frag.Timescale)
+}
+
+// end of the fragment in seconds
+func (frag *Fragment) EndSeconds() float64 {
+	return float64(frag.Pts+frag.Duration) / float64(frag.Timescale)
+}
+
+// converts a time between timescales, rounding to the nearest unit
+func Rescale(t uint64, from, to uint32) uint64 {
+	if from == to || from == 0 {
+		return t
+	}
+	// 128 bit intermediate product, a 90kHz decode time does not overflow for millennia anyway
+	hi, lo := bits.Mul64(t, uint64(to))
+	lo, carry := bits.Add64(lo, uint64(from)/2, 0)
+	if hi+carry >= uint64(from) {
+		// a forged decode time or duration out of range of the target timescale, Div64 would panic
+		return math.MaxUint64
+	}
+	quotient, _ := bits.Div64(hi+carry, lo, uint64(from))
+	return quotient
+}
+
+// average bitrate in bits per second over the fragments still in the keyframes window
+func (stream *InputStream) Bandwidth() uint64 {
+	last := stream.GetLastFragment()
+	keyframes := stream.windowKeyframes()
+	if len(keyframes) == 0 || last == nil || last.Seconds() <= keyframes[0].Seconds() {
+		return 0
+	}
+	bytes := uint64(0)
+	for seq := keyframes[0].Sequence; seq < last.Sequence; seq++ {
+		if frag, ok := stream.fragments.Get(seq); ok {
+			bytes += uint64(frag.ByteLength)
+		}
+	}
+	return uint64(float64(bytes*8) / (last.Seconds() - keyframes[0].Seconds()))
+}
+
+// method to add a keyframe fragment to the array, which is trimmed when the oldest segment is evicted
 func (stream *InputStream) AddKeyframe(frag *Fragment) {
+	frag.msn = stream.keyframeCount
+	stream.keyframeCount++
+	stream.keyframesMu.Lock()
 	stream.keyframes = append(stream.keyframes, frag)
-	if stream.keyframes[0].Pts < frag.Pts-float32(config.Ingester.HeapSize) {
-		stream.keyframes[0] = nil
-		stream.keyframes = stream.keyframes[1:]
-		// f, _ := ConvertSyncMapToMap[[]Fragment](&stream.fragments)
-		// fmt.Println("%v\n%v", f, stream.keyframes)
+	stream.keyframesMu.Unlock()
+}
+
+// Stop ends the ingestion of the stream and releases its fragments, the stream cannot be restarted
+func (stream *InputStream) Stop() {
+	stream.cancel()
+	stream.parsing.Lock() // wait for the source being parsed to fail
+	defer stream.parsing.Unlock()
+	for _, frag := range stream.fragments.Evict(math.MaxUint32) {
+		if frag.data != nil {
+			frag.data.Close()
+			stream.metrics.evicted(frag)
+		}
+	}
+	if stream.archive != nil {
+		stream.archive.Close()
 	}
 }
 
-// deletes all keys in the range [min, max] inclusive
-func deleteRange(m *sync.Map, min, max uint32, callback func(interface{})) {
-	m.Range(func(key, value interface{}) bool {
-		k := key.(uint32)
-		if k >= min && k <= max {
-			callback(value)
-			m.Delete(k)
+// releases the fragments dropped from memory, moving them to the archive first when there is one
+func (stream *InputStream) evict(fragments []*Fragment) {
+	for _, frag := range fragments {
+		if frag.data == nil {
+			continue
 		}
-		return true
-	})
+		stream.metrics.evicted(frag)
+		if stream.archive != nil {
+			// written and closed by the archive worker
+			err := stream.archive.Store(frag)
+			if err == nil {
+				continue
+			}
+			stream.log.Error("archiving fragment", "seq", frag.Sequence, "error", err)
+		}
+		frag.data.Close()
+	}
+}
+
+// init segment the fragments of the given generation refer to, nil when out of the window
+func (stream *InputStream) init(generation uint32) *initSegment {
+	if init, ok := stream.inits.Load(generation); ok {
+		return init.(*initSegment)
+	}
+	return nil
+}
+
+// keyframes in memory, the ingest appends to and trims its own copy of the slice
+func (stream *InputStream) windowKeyframes() []*Fragment {
+	stream.keyframesMu.RLock()
+	defer stream.keyframesMu.RUnlock()
+	return stream.keyframes
+}
+
+// keyframes of the archive followed by the ones still in memory, the whole time-shift window
+func (stream *InputStream) DvrKeyframes() []*Fragment {
+	keyframes := stream.windowKeyframes()
+	if stream.archive == nil || len(keyframes) == 0 {
+		return keyframes
+	}
+	return append(stream.archive.Keyframes(keyframes[0].Sequence), keyframes...)
+}
+
+// channel closed as soon as the next fragment is completed
+func (stream *InputStream) changed() <-chan struct{} {
+	stream.notifyMu.Lock()
+	defer stream.notifyMu.Unlock()
+	if stream.notify == nil {
+		stream.notify = make(chan struct{})
+	}
+	return stream.notify
+}
+
+// wakes up everyone waiting for a new fragment
+func (stream *InputStream) publish() {
+	stream.notifyMu.Lock()
+	defer stream.notifyMu.Unlock()
+	if stream.notify != nil {
+		close(stream.notify)
+	}
+	stream.notify = make(chan struct{})
 }
-func deleteOlder(m *sync.Map, max uint32, callback func(interface{})) {
-	m.Range(func(key, value interface{}) bool {
-		k := key.(uint32)
-		if k <= max {
-			callback(value)
-			m.Delete(k)
+
+// blocks until the condition holds after a fragment is completed, false on timeout or when the request is gone
+func (stream *InputStream) WaitUntil(ctx context.Context, timeout time.Duration, cond func() bool) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		changed := stream.changed() // before checking, not to miss a fragment in between
+		if cond() {
+			return true
 		}
-		return true
-	})
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// returns the fragment only once its mdat has been received
+func (stream *InputStream) GetCompleteFragment(seq uint32) *Fragment {
+	if frag, ok := stream.fragments.Get(seq); ok && frag.data != nil {
+		return frag
+	}
+	return nil
 }
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"testing"
+	"time"
+)
+
+// the content (moof + mdat) of a complete fragment
+func fragmentBytes(t *testing.T, frag *Fragment) []byte {
+	t.Helper()
+	b, err := io.ReadAll(io.NewSectionReader(frag.data, 0, frag.data.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestIngestHeap(t *testing.T) {
+	stream := newTestStream(t, STORE_HEAP)
+	if err := stream.Ingest(bytes.NewReader(testSource(6, 2))); !errors.Is(err, io.EOF) {
+		t.Fatalf("ingest ended with %v", err)
+	}
+	if stream.timescale != TEST_TIMESCALE || stream.codec == "" {
+		t.Fatalf("init not parsed: timescale %d, codec %q", stream.timescale, stream.codec)
+	}
+	for i := 0; i < 6; i++ {
+		frag := stream.GetCompleteFragment(uint32(i + 1))
+		if frag == nil {
+			t.Fatalf("fragment %d missing", i+1)
+		}
+		if frag.Pts != uint64(i*TEST_SAMPLES*TEST_SAMPLE_DURATION) || frag.Duration != TEST_SAMPLES*TEST_SAMPLE_DURATION {
+			t.Errorf("fragment %d at %d lasting %d", frag.Sequence, frag.Pts, frag.Duration)
+		}
+		if frag.Keyframe != (i%2 == 0) {
+			t.Errorf("fragment %d keyframe %v", frag.Sequence, frag.Keyframe)
+		}
+		want := testFragment(uint32(i+1), uint64(i*TEST_SAMPLES*TEST_SAMPLE_DURATION), i%2 == 0)
+		if got := fragmentBytes(t, frag); !bytes.Equal(got, want) || frag.ByteLength != uint32(len(want)) {
+			t.Errorf("fragment %d holds %d bytes (length %d), %d ingested", frag.Sequence, len(got), frag.ByteLength, len(want))
+		}
+	}
+	if len(stream.keyframes) != 3 || stream.keyframes[0].Sequence != 1 || stream.keyframes[2].Sequence != 5 {
+		t.Errorf("keyframes %v", stream.keyframes)
+	}
+	if stream.metrics.fragmentsIngested.Load() != 6 || stream.metrics.storedFragments.Load() != 6 {
+		t.Errorf("%d fragments ingested, %d stored", stream.metrics.fragmentsIngested.Load(), stream.metrics.storedFragments.Load())
+	}
+}
+
+func TestIngestHeapEviction(t *testing.T) {
+	stream := newTestStream(t, STORE_HEAP)
+	stream.Ingest(bytes.NewReader(testSource(30, 2)))
+
+	heapSize := stream.channel.ingester().HeapSize
+	if stored := uint32(stream.metrics.storedFragments.Load()); stored > heapSize+2 || stored < heapSize {
+		t.Errorf("%d fragments stored out of a heap of %d", stored, heapSize)
+	}
+	if stream.GetCompleteFragment(1) != nil {
+		t.Error("first fragment not evicted")
+	}
+	// the playlists list the keyframes, each of them must still be served
+	for _, keyframe := range stream.keyframes {
+		if stream.GetCompleteFragment(keyframe.Sequence) == nil {
+			t.Errorf("keyframe %d listed but evicted", keyframe.Sequence)
+		}
+	}
+	stream.fragments.Range(func(frag *Fragment) bool {
+		if frag.Sequence != stream.keyframes[0].Sequence {
+			t.Errorf("keyframes start at %d, fragments are kept from %d", stream.keyframes[0].Sequence, frag.Sequence)
+		}
+		return false
+	})
+	if last := stream.GetCompleteFragment(30); last == nil {
+		t.Error("last fragment missing")
+	}
+}
+
+func TestIngestDiscontinuity(t *testing.T) {
+	stream := newTestStream(t, STORE_HEAP)
+	stream.Ingest(bytes.NewReader(testSource(4, 2)))
+	end := stream.GetLastFragment().EndSeconds()
+
+	// the encoder restarts from sequence 1 and decode time 0
+	stream.Ingest(bytes.NewReader(testSource(4, 2)))
+	if len(stream.discontinuities) != 1 || stream.discontinuities[0] != 5 {
+		t.Fatalf("discontinuities %v", stream.discontinuities)
+	}
+	frag := stream.GetCompleteFragment(5)
+	if frag == nil {
+		t.Fatal("first fragment of the new timeline missing")
+	}
+	if frag.Seconds() < end || frag.generation != 2 {
+		t.Errorf("fragment 5 at %f of generation %d, previous timeline ending at %f", frag.Seconds(), frag.generation, end)
+	}
+	if want := testFragment(1, 0, true); !bytes.Equal(fragmentBytes(t, frag), want) {
+		t.Error("fragment 5 content differs from the one ingested")
+	}
+	if stream.GetCompleteFragment(8) == nil {
+		t.Error("last fragment of the new timeline missing")
+	}
+}
+
+func TestDiscontinuityWallClock(t *testing.T) {
+	stream := newTestStream(t, STORE_HEAP)
+	events := make(chan Event, 1)
+	stream.events = events
+	stream.Ingest(bytes.NewReader(testSource(4, 2)))
+
+	// the first encoder started a minute ago and stopped after 4 seconds
+	stream.timestamp = stream.timestamp.Add(-time.Minute)
+	stream.Ingest(bytes.NewReader(testSource(4, 2)))
+	frag := stream.GetCompleteFragment(5)
+	if frag == nil {
+		t.Fatal("first fragment of the new timeline missing")
+	}
+	// it ended when it was received, on the wall clock
+	if started := stream.wallClock(frag.Pts, frag.Timescale); time.Since(started)-time.Second > time.Second {
+		t.Errorf("fragment 5 started at %s, %s ago", started, time.Since(started))
+	}
+
+	// the segment before the outage lasts as long as its fragments
+	keyframes := stream.DvrKeyframes()
+	if len(keyframes) != 4 || keyframes[2].Sequence != 5 {
+		t.Fatalf("keyframes %v", keyframes)
+	}
+	if d := stream.segmentSeconds(keyframes, 1); d != 2 {
+		t.Errorf("segment 3 lasts %f seconds", d)
+	}
+	if timeline := stream.SegmentTimeline(1); len(timeline.S) != 1 || timeline.S[0].D != 2*TEST_SAMPLES*TEST_SAMPLE_DURATION || timeline.S[0].R != 1 {
+		t.Errorf("timeline before the outage %+v", timeline.S)
+	}
+	// at the decode time of the restarted encoder
+	if timeline := stream.SegmentTimeline(2); len(timeline.S) != 1 || timeline.S[0].T != 0 {
+		t.Errorf("timeline after the outage %+v", timeline.S)
+	}
+
+	select {
+	case event := <-events:
+		if event.Name != "discontinuity" || !bytes.Contains(event.Data, []byte(`"seq":5`)) {
+			t.Errorf("event %s: %s", event.Name, event.Data)
+		}
+	default:
+		t.Error("no discontinuity event")
+	}
+
+	// nobody reading the events does not stall the ingest
+	stream.Ingest(bytes.NewReader(testSource(4, 2)))
+	stream.Ingest(bytes.NewReader(testSource(4, 2)))
+	if len(stream.discontinuities) != 3 {
+		t.Errorf("discontinuities %v", stream.discontinuities)
+	}
+}
+
+func TestRescale(t *testing.T) {
+	for _, test := range []struct {
+		t        uint64
+		from, to uint32
+		expected uint64
+	}{
+		{90000, 90000, 1000, 1000},
+		{3003, 30000, 90000, 9009},
+		{1, 3, 2, 1},                                             // 0.67 rounds up
+		{1 << 60, 48000, 1000, 24019198012642645},                // the product needs more than 64 bits
+		{math.MaxUint64, 1, uint32(time.Second), math.MaxUint64}, // saturates instead of overflowing
+	} {
+		if got := Rescale(test.t, test.from, test.to); got != test.expected {
+			t.Errorf("%d from %d to %d: %d, expected %d", test.t, test.from, test.to, got, test.expected)
+		}
+	}
+}
+
+// moof and mdat of AAC frames of 1024 samples without sample flags, every audio fragment is a sync point
+func testAudioFragment(seq uint32, dt uint64, frames int) []byte {
+	sizes := []byte{}
+	payload := []byte{}
+	for i := 0; i < frames; i++ {
+		frame := bytes.Repeat([]byte{byte(seq), byte(i)}, 50+i)
+		sizes = append(sizes, u32(uint32(len(frame)))...)
+		payload = append(payload, frame...)
+	}
+	moof := func(dataOffset uint32) []byte {
+		trun := makeFullBox("trun", 0, 0x000001|0x000200, u32(uint32(frames)), u32(dataOffset), sizes)
+		tfhd := makeFullBox("tfhd", 0, 0x020008, u32(1), u32(1024))
+		return makeBox("moof", makeFullBox("mfhd", 0, 0, u32(seq)), makeBox("traf", tfhd, makeFullBox("tfdt", 1, 0, u64(dt)), trun))
+	}
+	m := moof(0)
+	m = moof(uint32(len(m) + 8))
+	return append(m, makeBox("mdat", payload)...)
+}
+
+func TestIngestAudio(t *testing.T) {
+	// AAC-LC 48 kHz stereo: audioObjectType 2, samplingFrequencyIndex 3, channelConfiguration 2
+	moov := testTrackMoov("soun", 48000, testAudioEntry("mp4a", 2, 48000, testEsds(0x40, 128000, 0x11, 0x90)))
+	source := append(makeBox("ftyp", []byte("iso5"), u32(0), []byte("iso5iso6mp41")), moov...)
+	for i := 0; i < 4; i++ {
+		source = append(source, testAudioFragment(uint32(i+1), uint64(i*47*1024), 47)...)
+	}
+	stream := newTestStream(t, STORE_HEAP)
+	if err := stream.Ingest(bytes.NewReader(source)); !errors.Is(err, io.EOF) {
+		t.Fatalf("ingest ended with %v", err)
+	}
+	repr := stream.repr
+	if repr.Type != AUDIO || repr.Codecs != "mp4a.40.2" || repr.SampleRate != 48000 || repr.Channels != 2 || repr.Bitrate != 128000 || stream.timescale != 48000 {
+		t.Fatalf("audio representation %+v, timescale %d", *repr, stream.timescale)
+	}
+	for seq := uint32(1); seq <= 4; seq++ {
+		frag := stream.GetCompleteFragment(seq)
+		if frag == nil {
+			t.Fatalf("fragment %d missing", seq)
+		}
+		// the whole mdat payload can be decoded on its own
+		mdat := testAudioFragment(seq, 0, 47)[len(testMoof(testAudioFragment(seq, 0, 47))):]
+		if !frag.Keyframe || frag.Timescale != 48000 || frag.Duration != 47*1024 || frag.IFrameSize != uint32(len(mdat)-8) {
+			t.Errorf("fragment %d: keyframe %v, timescale %d, duration %d, I-frame size %d", seq, frag.Keyframe, frag.Timescale, frag.Duration, frag.IFrameSize)
+		}
+	}
+	if len(stream.keyframes) != 4 {
+		t.Errorf("%d segments of a single fragment, 4 expected", len(stream.keyframes))
+	}
+}
+
+func TestParseOpusInit(t *testing.T) {
+	// Version(1) OutputChannelCount(1) PreSkip(2) InputSampleRate(4) OutputGain(2) ChannelMappingFamily(1)
+	dOps := makeBox("dOps", []byte{0, 1}, u16(312), u32(44100), u16(0), []byte{0})
+	stream := newTestStream(t, STORE_HEAP)
+	if err := stream.parseInit(testTrackMoov("soun", 48000, testAudioEntry("Opus", 2, 48000, dOps))); err != nil {
+		t.Fatal(err)
+	}
+	if repr := stream.repr; repr.Type != AUDIO || repr.Codecs != "opus" || repr.SampleRate != 44100 || repr.Channels != 1 {
+		t.Errorf("opus representation %+v", *repr)
+	}
+}
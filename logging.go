@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Log struct {
+	Format     string            // "text" (default) or "json"
+	Level      string            // debug, info (default), warn or error
+	AccessLog  bool              // one line per HTTP request, with status, bytes and latency
+	Components map[string]string // level per component: main, stream, http, sse, tls, access
+}
+
+// loggers of the components not tied to a representation, replaced once the configuration is loaded
+var (
+	mainLog          = slog.Default()
+	httpLog          = slog.Default()
+	accessLog        = slog.Default()
+	accessLogEnabled atomic.Bool
+)
+
+// component -> *slog.LevelVar shared by the loggers of the component, so that a reload changes their level
+var componentLevels sync.Map
+
+var logOutput io.Writer = os.Stdout
+
+func parseLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	return l, err
+}
+
+// level of the component, falling back to the default one
+func (config Log) level(component string) slog.Level {
+	for _, level := range []string{config.Components[component], config.Level} {
+		if level == "" {
+			continue
+		}
+		if l, err := parseLevel(level); err == nil {
+			return l
+		}
+	}
+	return slog.LevelInfo
+}
+
+// Logger returns the logger of a component, at the given level (a *slog.LevelVar can be changed later on)
+func (config Log) Logger(component string, level slog.Leveler) *slog.Logger {
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if strings.EqualFold(config.Format, "json") {
+		handler = slog.NewJSONHandler(logOutput, options)
+	} else {
+		handler = slog.NewTextHandler(logOutput, options)
+	}
+	return slog.New(handler).With("component", component)
+}
+
+// ComponentLogger returns the logger of a component at its configured level
+func (config Log) ComponentLogger(component string) *slog.Logger {
+	level, _ := componentLevels.LoadOrStore(component, new(slog.LevelVar))
+	level.(*slog.LevelVar).Set(config.level(component))
+	return config.Logger(component, level.(*slog.LevelVar))
+}
+
+// Apply changes the level of the component loggers already created and toggles the access log
+// the format cannot be changed without a restart
+func (config Log) Apply() {
+	componentLevels.Range(func(component, level any) bool {
+		level.(*slog.LevelVar).Set(config.level(component.(string)))
+		return true
+	})
+	accessLogEnabled.Store(config.AccessLog)
+}
+
+// StreamLevel is the level of a representation, whose own one (or Log = true, meaning debug) wins over the stream component one
+func (config Log) StreamLevel(repr *Representation) slog.Level {
+	level := config.level("stream")
+	if repr.Log {
+		level = slog.LevelDebug
+	}
+	if l, err := parseLevel(repr.LogLevel); repr.LogLevel != "" && err == nil {
+		level = l
+	}
+	return level
+}
+
+// StreamLogger returns the logger of a representation of the channel
+func (config Log) StreamLogger(channel string, repr *Representation, level slog.Leveler) *slog.Logger {
+	logger := config.Logger("stream", level)
+	if channel != "" {
+		logger = logger.With("channel", channel)
+	}
+	return logger.With("representation", repr.Id)
+}
+
+// Validate rejects unknown formats and levels, which would otherwise be silently ignored
+func (config Log) Validate() error {
+	if config.Format != "" && !strings.EqualFold(config.Format, "text") && !strings.EqualFold(config.Format, "json") {
+		return fmt.Errorf("unknown log format %q", config.Format)
+	}
+	levels := []string{config.Level}
+	for _, level := range config.Components {
+		levels = append(levels, level)
+	}
+	for _, level := range levels {
+		if _, err := parseLevel(level); level != "" && err != nil {
+			return fmt.Errorf("unknown log level %q", level)
+		}
+	}
+	return nil
+}
+
+// AccessLogHandler logs every request once it is answered, when the access log is enabled
+func AccessLogHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !accessLogEnabled.Load() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := newResponseRecorder(w)
+		next.ServeHTTP(rec, r)
+		accessLog.Info("request",
+			"method", r.Method,
+			"path", redactedURI(r.URL),
+			"proto", r.Proto,
+			"remote", r.RemoteAddr,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+		)
+	})
+}
+
+// query parameters carrying credentials, their values never reach the logs
+var secretParams = map[string]bool{"sig": true, "access_token": true}
+
+// the request URI with the credentials of the query replaced, the other parameters are left as sent
+func redactedURI(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.RequestURI()
+	}
+	params := strings.Split(u.RawQuery, "&")
+	for i, param := range params {
+		key, _, _ := strings.Cut(param, "=")
+		if name, err := url.QueryUnescape(key); err == nil && secretParams[name] {
+			params[i] = key + "=REDACTED"
+		}
+	}
+	redacted := *u
+	redacted.RawQuery = strings.Join(params, "&")
+	return redacted.RequestURI()
+}
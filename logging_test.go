@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRedactedURI(t *testing.T) {
+	for uri, want := range map[string]string{
+		"/mux/v/1": "/mux/v/1",
+		"/mux/manifest.mpd?exp=1&prefix=%2Fmux&sig=abc":     "/mux/manifest.mpd?exp=1&prefix=%2Fmux&sig=REDACTED",
+		"/mux/events?access_token=a.b.c&CMCD=sid%3D%22x%22": "/mux/events?access_token=REDACTED&CMCD=sid%3D%22x%22",
+		"/mux/v/1?access%5Ftoken=a.b.c&sig":                 "/mux/v/1?access%5Ftoken=REDACTED&sig=REDACTED",
+	} {
+		u, err := url.ParseRequestURI(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := redactedURI(u); got != want {
+			t.Errorf("%s logged as %s", uri, got)
+		}
+	}
+}
+
+// the JSON lines written by the loggers created during the test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	previous := logOutput
+	t.Cleanup(func() { logOutput = previous })
+	output := &bytes.Buffer{}
+	logOutput = output
+	return output
+}
+
+func logLines(t *testing.T, output *bytes.Buffer) []map[string]any {
+	t.Helper()
+	lines := []map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		record := map[string]any{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("not a JSON line: %s", line)
+		}
+		lines = append(lines, record)
+	}
+	output.Reset()
+	return lines
+}
+
+func TestComponentLevels(t *testing.T) {
+	output := captureLogs(t)
+	config := Log{Format: "json", Level: "warn", Components: map[string]string{"http": "debug"}}
+	httpLogger, sseLogger := config.ComponentLogger("http"), config.ComponentLogger("sse")
+	httpLogger.Debug("request refused", "path", "/mux")
+	sseLogger.Info("client connected")
+	sseLogger.Warn("client too slow")
+	lines := logLines(t, output)
+	if len(lines) != 2 || lines[0]["component"] != "http" || lines[0]["level"] != "DEBUG" || lines[0]["path"] != "/mux" || lines[1]["component"] != "sse" || lines[1]["level"] != "WARN" {
+		t.Errorf("logged %v", lines)
+	}
+
+	// a reload changes the level of the loggers already handed out
+	Log{Level: "error"}.Apply()
+	httpLogger.Warn("request refused")
+	sseLogger.Error("broadcaster stopped")
+	if lines := logLines(t, output); len(lines) != 1 || lines[0]["component"] != "sse" {
+		t.Errorf("logged %v after the reload", lines)
+	}
+	Log{}.Apply()
+}
+
+func TestStreamLevel(t *testing.T) {
+	config := Log{Level: "error", Components: map[string]string{"stream": "warn"}}
+	for _, test := range []struct {
+		repr     Representation
+		expected slog.Level
+	}{
+		{Representation{}, slog.LevelWarn},
+		{Representation{Log: true}, slog.LevelDebug},
+		{Representation{Log: true, LogLevel: "error"}, slog.LevelError},
+		{Representation{LogLevel: "info"}, slog.LevelInfo},
+	} {
+		if level := config.StreamLevel(&test.repr); level != test.expected {
+			t.Errorf("%+v: level %s, expected %s", test.repr, level, test.expected)
+		}
+	}
+
+	output := captureLogs(t)
+	Log{Format: "json"}.StreamLogger("mux", &Representation{Id: "v"}, slog.LevelInfo).Info("received moov atom")
+	if lines := logLines(t, output); len(lines) != 1 || lines[0]["component"] != "stream" || lines[0]["channel"] != "mux" || lines[0]["representation"] != "v" {
+		t.Errorf("logged %v", lines)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	output := captureLogs(t)
+	previous := accessLog
+	t.Cleanup(func() {
+		accessLog = previous
+		accessLogEnabled.Store(false)
+	})
+	accessLog = Log{Format: "json"}.ComponentLogger("access")
+	handler := AccessLogHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/mux/v/1?sig=abc", nil))
+	if lines := logLines(t, output); len(lines) != 0 {
+		t.Errorf("logged %v with the access log disabled", lines)
+	}
+	accessLogEnabled.Store(true)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/mux/v/1?sig=abc", nil))
+	lines := logLines(t, output)
+	if len(lines) != 1 {
+		t.Fatalf("logged %v", lines)
+	}
+	line := lines[0]
+	if line["method"] != "GET" || line["path"] != "/mux/v/1?sig=REDACTED" || line["status"] != float64(http.StatusCreated) || line["bytes"] != float64(5) {
+		t.Errorf("access log %v", line)
+	}
+	if duration, ok := line["duration_ms"].(float64); !ok || duration < 0 {
+		t.Errorf("duration_ms %v", line["duration_ms"])
+	}
+}
+
+func TestValidateLog(t *testing.T) {
+	for config, valid := range map[*Log]bool{
+		{}:                              true,
+		{Format: "JSON", Level: "warn"}: true,
+		{Format: "logfmt"}:              false,
+		{Level: "verbose"}:              false,
+		{Components: map[string]string{"sse": "debug"}}: true,
+		{Components: map[string]string{"sse": "loud"}}:  false,
+	} {
+		if err := config.Validate(); (err == nil) != valid {
+			t.Errorf("%+v: %v", *config, err)
+		}
+	}
+}
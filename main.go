@@ -1,32 +1,53 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
 	"net/http"
 	"os"
 	"sync"
-	"syscall"
-	"time"
-
-	"github.com/BurntSushi/toml"
+	"sync/atomic"
 )
 
 type Config struct {
-	Representations map[string]*Representation
+	Representations map[string]*Representation // single channel served under Root, when there are no Channels
+	Channels        map[string]*Channel
 	Server          Server
 	Ingester        Ingester
+	Archive         Archive
+	Log             Log
+	Auth            Auth
 }
 
 type Representation struct {
-	Width     uint32 `json:"width"`
-	Height    uint32 `json:"height"`
-	Log       bool   `json:"-"`
-	Pipe      string `json:"-"`
-	Id        string `json:"-"`
-	Timescale uint32 `json:"-"`
+	Type       string     `json:"type"` // "video" or "audio", from the handler of the init segment
+	Width      uint32     `json:"width"`
+	Height     uint32     `json:"height"`
+	SampleRate uint32     `json:"sample_rate,omitempty"`
+	Channels   uint16     `json:"channels,omitempty"`
+	Bitrate    uint32     `json:"bitrate,omitempty"` // declared by the encoder (esds), if any
+	Codecs     string     `json:"codecs"`            // RFC 6381, for MediaSource.isTypeSupported
+	FrameRate  float32    `json:"frame_rate,omitempty"`
+	Sar        string     `json:"sar,omitempty"` // pixel aspect ratio
+	Color      *ColorInfo `json:"color,omitempty"`
+	Log        bool       `json:"-"` // per fragment debug lines, same as LogLevel = "debug"
+	LogLevel   string     `json:"-"`
+	Pipe       string     `json:"-"`
+	Id         string     `json:"-"`
+	Timescale  uint32     `json:"-"`
+}
+
+// ColorInfo is the nclx colour description (ISO/IEC 23091-2 code points)
+type ColorInfo struct {
+	Primaries uint16 `json:"primaries"`
+	Transfer  uint16 `json:"transfer"`
+	Matrix    uint16 `json:"matrix"`
+	FullRange bool   `json:"full_range"`
 }
 
+const (
+	VIDEO = "video"
+	AUDIO = "audio"
+)
+
 type Forecast map[string][]*Fragment // per each presentation - contains Update, or size of the fragment + keyframe flag
 
 type Ingester struct {
@@ -34,144 +55,66 @@ type Ingester struct {
 	FragmentDuration    uint32 `json:"fragment_duration"`
 	ControllerFrequency int    `json:"controller_frequency"`
 	Horizon             int    `json:"horizon"`
+	Store               string `json:"-"` // memfd (default), heap or file
+	StoreDirectory      string `json:"-"` // where the file store keeps its fragments, the system temporary directory if empty
 }
 
-var streams []*InputStream
-var config Config
+var channels []*Channel
+var config atomic.Pointer[Config] // replaced as a whole on reload, never modified in place
+var configFile = "config.toml"
 
 func main() {
 
-	configFile := "config.toml"
 	if len(os.Args) > 1 {
 		configFile = os.Args[1]
 	}
 
-	if _, err := toml.DecodeFile(configFile, &config); err != nil {
-		fmt.Printf("Error loading config: %s\n", err)
+	loaded, err := loadConfig(configFile)
+	if err != nil {
+		mainLog.Error("loading config", "file", configFile, "error", err)
 		os.Exit(1)
 	}
+	config.Store(loaded)
+	mainLog = loaded.Log.ComponentLogger("main")
+	httpLog = loaded.Log.ComponentLogger("http")
+	accessLog = loaded.Log.ComponentLogger("access")
+	accessLogEnabled.Store(loaded.Log.AccessLog)
 
-	forecast := sync.Map{}
-	dataChannel := make(chan []byte)
-	broadcaster := NewBroadcaster(dataChannel)
-
-	if err := broadcaster.Start(); err != nil {
-		fmt.Printf("Failed to start broadcaster: %v", err)
-	}
-	defer broadcaster.Stop()
-	http.HandleFunc(config.Server.Root+"/events", broadcaster.HandlerFunc())
+	list, _ := loaded.channelList() // validated by loadConfig
 
 	var wg sync.WaitGroup
-
-	for streamId, repr := range config.Representations {
-		fmt.Printf("Representation #%s on pipe %s\n", streamId, repr.Pipe)
-		repr.Id = streamId
-
-		namedPipe, err := os.OpenFile(repr.Pipe, syscall.O_RDWR|syscall.O_NONBLOCK, os.ModeNamedPipe)
-		if err != nil {
-			panic(err)
-		}
-		defer namedPipe.Close() // will be closed at main() exit as a stack
-
-		stream := &InputStream{
-			repr:            repr,
-			fragmentsWindow: NewCircularBuffer[Fragment](config.Ingester.Horizon), // items (windows) are indexed by pts
+	for _, channel := range list {
+		if err := channel.Start(&wg, http.DefaultServeMux); err != nil {
+			mainLog.Error("starting channel", "channel", channel.Name, "error", err)
+			os.Exit(1)
 		}
-
-		wg.Add(1)
-		streams = append(streams, stream)
-
-		go func() {
-			toSend := 0 // keep track of how many to send still via SSE
-			for update := range stream.fragmentsWindow.Updates() {
-				window, _ := forecast.LoadOrStore(stream.fragmentsWindow.latest.Pts, &sync.Map{})
-				window.(*sync.Map).Store(streamId, update)
-
-				if w, ok := forecast.Load(stream.fragmentsWindow.latest.Pts); ok {
-					// IMPR: len for sync.Maps is not available
-					regularMap, count := ConvertSyncMapToMap[[]*Fragment](w.(*sync.Map))
-
-					// group all representation per update
-					if count < len(config.Representations) {
-						continue
-					}
-					// fmt.Println(stream.sizesWindow.latest.Pts, "Common")
-					// lastCommonPts = float32(stream.fragmentsWindow.latest.Pts)
-					// lastCommonSeq = uint32(stream.fragmentsWindow.latest.Sequence)
-
-					if data, err := json.Marshal(struct {
-						Pts    float32  `json:"pts"`
-						Seq    uint32   `json:"seq"`
-						Window Forecast `json:"window"`
-					}{
-						Pts:    stream.fragmentsWindow.latest.Pts,
-						Seq:    stream.fragmentsWindow.latest.Sequence,
-						Window: regularMap,
-					}); err == nil {
-						toSend++
-						if toSend == config.Ingester.ControllerFrequency {
-							dataChannel <- data
-							toSend = 0
-						}
-					}
-				}
-
-			}
-		}()
-
-		go func() {
-			defer wg.Done()
-			stream.Serve() // register HTTP handler
-			stream.Parse(namedPipe)
-		}()
-
+		defer channel.broadcaster.Stop()
+		channels = append(channels, channel)
 	}
 
-	http.HandleFunc(config.Server.Root+"/", func(w http.ResponseWriter, r *http.Request) {
-		common_start_time := streams[0].timestamp
-		lastSeqNumber := uint32(streams[0].lastSeqNumber)
-
-		for _, stream := range streams {
-			// gli stream _possono_ essere inizializzati in tempi diversi (primo moov atom)
-			if stream.timestamp.After(common_start_time) {
-				common_start_time = stream.timestamp
-			}
-			// gli stream _dovrebbero_ avere in sincronia lo stesso numero di sequenza
-			if stream.lastSeqNumber < lastSeqNumber {
-				lastSeqNumber = stream.lastSeqNumber
-				fmt.Println("! SEQ number mismatch ! Gathering lowest !z")
-			}
-		}
-		w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
-		w.Header().Set("Expires", "0")
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Expose-Headers", "ruddr-time")
-		w.Header().Set("Ruddr-Time", fmt.Sprintf("%d", time.Now().UnixMilli()))
-		w.Header().Set("Timing-Allow-Origin", "*")
-
-		keyframes := make(map[string][]*Fragment)
-		for _, stream := range streams {
-			keyframes[stream.repr.Id] = stream.keyframes
-		}
-
-		w.WriteHeader(http.StatusOK)
+	http.HandleFunc("/metrics", MetricsHandler)
+	http.HandleFunc("/healthz", HealthzHandler)
+	http.HandleFunc("/readyz", ReadyzHandler)
+	http.HandleFunc(loaded.Server.Root+"/admin/", AdminHandler)
+	go WatchReload()
 
-		json.NewEncoder(w).Encode(Manifest{
-			Config:          config.Ingester,
-			Start:           common_start_time,
-			Head:            lastSeqNumber,
-			Epoch:           uint64(common_start_time.UnixMilli()),
-			Representations: config.Representations,
-			Keyframes:       keyframes,
-		})
-	})
-	http.ListenAndServe(config.Server.Address, nil)
+	if err := loaded.Server.ListenAndServe(AccessLogHandler(http.DefaultServeMux)); err != nil {
+		mainLog.Error("serving", "address", loaded.Server.Address, "error", err)
+	}
 
 	wg.Wait()
 
 }
 
+// the representations of every channel
+func allStreams() []*InputStream {
+	all := []*InputStream{}
+	for _, channel := range channels {
+		all = append(all, channel.Streams()...)
+	}
+	return all
+}
+
 func ConvertSyncMapToMap[T any](syncMap *sync.Map) (map[string]T, int) {
 	regularMap := make(map[string]T)
 
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StreamMetrics are the counters and gauges of a representation, updated by ingest and delivery
+type StreamMetrics struct {
+	fragmentsIngested atomic.Uint64
+	bytesIngested     atomic.Uint64
+	lastIngest        atomic.Int64 // unix nanoseconds of the last completed fragment
+	storedFragments   atomic.Int64
+	storedBytes       atomic.Int64
+	evictions         atomic.Uint64
+	bytesServed       atomic.Uint64
+	sendfileErrors    atomic.Uint64
+	deliveryRate      atomic.Uint64 // moving average of the segment responses, for the CMSD etp [kbps]
+	requests          sync.Map      // status code -> *atomic.Uint64
+}
+
+// a fragment completed and written to the store
+func (metrics *StreamMetrics) ingested(frag *Fragment) {
+	metrics.fragmentsIngested.Add(1)
+	metrics.bytesIngested.Add(uint64(frag.ByteLength))
+	metrics.storedFragments.Add(1)
+	metrics.storedBytes.Add(int64(frag.ByteLength))
+	metrics.lastIngest.Store(time.Now().UnixNano())
+}
+
+// a complete fragment dropped from the store
+func (metrics *StreamMetrics) evicted(frag *Fragment) {
+	metrics.evictions.Add(1)
+	metrics.storedFragments.Add(-1)
+	metrics.storedBytes.Add(-int64(frag.ByteLength))
+}
+
+// a request answered by the representation handler
+func (metrics *StreamMetrics) served(rec *responseRecorder) {
+	counter, _ := metrics.requests.LoadOrStore(rec.status, &atomic.Uint64{})
+	counter.(*atomic.Uint64).Add(1)
+	metrics.bytesServed.Add(uint64(rec.bytes))
+}
+
+// responseRecorder keeps the status code and the body size of a response, still exposing the
+// io.ReaderFrom (sendfile) and http.Flusher (chunked segments, SSE) of the wrapped ResponseWriter
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *responseRecorder) ReadFrom(src io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := rec.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{rec.ResponseWriter}, src)
+	}
+	rec.bytes += n
+	return n, err
+}
+
+func (rec *responseRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// MetricsHandler writes the metrics of every representation, of the SSE broadcasters and of the CMCD sessions in the Prometheus text format
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	sorted := allStreams()
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].channel.Name != sorted[j].channel.Name {
+			return sorted[i].channel.Name < sorted[j].channel.Name
+		}
+		return sorted[i].repr.Id < sorted[j].repr.Id
+	})
+	now := time.Now()
+
+	var b strings.Builder
+	family := func(name, kind, help string, value func(stream *InputStream) float64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, stream := range sorted {
+			fmt.Fprintf(&b, "%s{channel=%q,representation=%q} %g\n", name, stream.channel.Name, stream.repr.Id, value(stream))
+		}
+	}
+
+	family("ruddr_fragments_ingested_total", "counter", "Fragments received complete (moof and mdat).", func(s *InputStream) float64 {
+		return float64(s.metrics.fragmentsIngested.Load())
+	})
+	family("ruddr_ingested_bytes_total", "counter", "Bytes of the fragments received.", func(s *InputStream) float64 {
+		return float64(s.metrics.bytesIngested.Load())
+	})
+	family("ruddr_last_sequence", "gauge", "Sequence number of the last fragment.", func(s *InputStream) float64 {
+		return float64(s.lastSeqNumber.Load())
+	})
+	family("ruddr_last_pts_seconds", "gauge", "Decode time of the last complete fragment.", func(s *InputStream) float64 {
+		if last := s.GetCompleteFragment(s.headSequence()); last != nil {
+			return last.Seconds()
+		}
+		return 0
+	})
+	family("ruddr_ingest_lag_seconds", "gauge", "Seconds since the last fragment was completed.", func(s *InputStream) float64 {
+		if last := s.metrics.lastIngest.Load(); last != 0 {
+			return now.Sub(time.Unix(0, last)).Seconds()
+		}
+		return 0
+	})
+	family("ruddr_stored_fragments", "gauge", "Complete fragments held by the fragment store.", func(s *InputStream) float64 {
+		return float64(s.metrics.storedFragments.Load())
+	})
+	family("ruddr_stored_bytes", "gauge", "Bytes held by the fragment store (memfd, heap or file).", func(s *InputStream) float64 {
+		return float64(s.metrics.storedBytes.Load())
+	})
+	family("ruddr_evicted_fragments_total", "counter", "Fragments evicted from the fragment store.", func(s *InputStream) float64 {
+		return float64(s.metrics.evictions.Load())
+	})
+	family("ruddr_served_bytes_total", "counter", "Response bytes written by the representation handler.", func(s *InputStream) float64 {
+		return float64(s.metrics.bytesServed.Load())
+	})
+	family("ruddr_sendfile_errors_total", "counter", "Failures writing file backed fragments to the client.", func(s *InputStream) float64 {
+		return float64(s.metrics.sendfileErrors.Load())
+	})
+
+	fmt.Fprintf(&b, "# HELP ruddr_requests_total Requests to the representation handler by status code.\n# TYPE ruddr_requests_total counter\n")
+	for _, stream := range sorted {
+		codes := []int{}
+		stream.metrics.requests.Range(func(key, value any) bool {
+			codes = append(codes, key.(int))
+			return true
+		})
+		sort.Ints(codes)
+		for _, code := range codes {
+			counter, _ := stream.metrics.requests.Load(code)
+			fmt.Fprintf(&b, "ruddr_requests_total{channel=%q,representation=%q,code=\"%d\"} %d\n", stream.channel.Name, stream.repr.Id, code, counter.(*atomic.Uint64).Load())
+		}
+	}
+
+	fmt.Fprintf(&b, "# HELP ruddr_sse_clients Connected SSE clients.\n# TYPE ruddr_sse_clients gauge\n")
+	for _, channel := range channels {
+		fmt.Fprintf(&b, "ruddr_sse_clients{channel=%q} %d\n", channel.Name, channel.broadcaster.ClientCount())
+	}
+	fmt.Fprintf(&b, "# HELP ruddr_sse_dropped_events_total Events not delivered to slow SSE clients.\n# TYPE ruddr_sse_dropped_events_total counter\n")
+	for _, channel := range channels {
+		fmt.Fprintf(&b, "ruddr_sse_dropped_events_total{channel=%q} %d\n", channel.Name, channel.broadcaster.DroppedEvents())
+	}
+
+	summaries := map[*Channel]CmcdSummary{}
+	for _, channel := range channels {
+		if summary := channel.cmcd.Summary(); summary != nil {
+			summaries[channel] = *summary
+		}
+	}
+	cmcd := func(name, kind, help string, value func(channel *Channel, summary CmcdSummary) float64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, channel := range channels {
+			fmt.Fprintf(&b, "%s{channel=%q} %g\n", name, channel.Name, value(channel, summaries[channel]))
+		}
+	}
+	cmcd("ruddr_cmcd_requests_total", "counter", "Requests carrying CMCD with a session id.", func(c *Channel, _ CmcdSummary) float64 {
+		return float64(c.cmcd.requests.Load())
+	})
+	cmcd("ruddr_cmcd_stalls_total", "counter", "Requests reporting a buffer starvation (bs).", func(c *Channel, _ CmcdSummary) float64 {
+		return float64(c.cmcd.stalls.Load())
+	})
+	cmcd("ruddr_cmcd_sessions", "gauge", "Player sessions that reported CMCD recently.", func(_ *Channel, s CmcdSummary) float64 {
+		return float64(s.Sessions)
+	})
+	cmcd("ruddr_cmcd_starved_sessions", "gauge", "Sessions whose last request reported a buffer starvation.", func(_ *Channel, s CmcdSummary) float64 {
+		return float64(s.Starved)
+	})
+	cmcd("ruddr_cmcd_buffer_length_seconds", "gauge", "Median buffer length reported by the sessions (bl).", func(_ *Channel, s CmcdSummary) float64 {
+		return float64(s.BufferLength) / 1000
+	})
+	cmcd("ruddr_cmcd_throughput_bits_per_second", "gauge", "Median throughput measured by the sessions (mtp).", func(_ *Channel, s CmcdSummary) float64 {
+		return float64(s.Throughput) * 1000
+	})
+	fmt.Fprintf(&b, "# HELP ruddr_cmcd_representation_sessions Sessions by the representation of their last segment.\n# TYPE ruddr_cmcd_representation_sessions gauge\n")
+	for _, stream := range sorted {
+		fmt.Fprintf(&b, "ruddr_cmcd_representation_sessions{channel=%q,representation=%q} %d\n", stream.channel.Name, stream.repr.Id, summaries[stream.channel].Representations[stream.repr.Id])
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprint(w, b.String())
+}
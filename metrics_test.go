@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the samples of the metrics output by name and labels, e.g. `ruddr_last_sequence{channel="test",representation="v"}`
+func scrapeMetrics(t *testing.T) map[string]string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	MetricsHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %q", contentType)
+	}
+	samples := map[string]string{}
+	described := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		if name, ok := strings.CutPrefix(line, "# TYPE "); ok {
+			described[strings.Fields(name)[0]] = true
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		series, value, _ := strings.Cut(line, " ")
+		if name, _, _ := strings.Cut(series, "{"); !described[name] {
+			t.Errorf("%s without TYPE", name)
+		}
+		samples[series] = value
+	}
+	return samples
+}
+
+func TestMetricsHandler(t *testing.T) {
+	stream, server := newTestServer(t, STORE_HEAP, false)
+	channel := stream.channel
+	channel.streams = []*InputStream{stream}
+	channel.broadcaster = NewBroadcaster(make(chan Event), mainLog)
+	previous := channels
+	channels = []*Channel{channel}
+	t.Cleanup(func() { channels = previous })
+
+	served := 0
+	for _, path := range []string{"3", "3", "99"} {
+		response, err := http.Get(server.URL + "/test/v/" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		served += len(body)
+	}
+	channel.cmcd.update(Cmcd{"sid": "a", "bl": "3000", "bs": "true"}, "test", "v", "127.0.0.1", time.Now())
+	channel.cmcd.update(Cmcd{"sid": "b", "bl": "5000"}, "test", "v", "127.0.0.1", time.Now())
+
+	samples := scrapeMetrics(t)
+	v := `{channel="test",representation="v"}`
+	for series, expected := range map[string]string{
+		"ruddr_fragments_ingested_total" + v:                                 "6",
+		"ruddr_ingested_bytes_total" + v:                                     fmt.Sprint(len(testSource(6, 2)) - len(testInit())),
+		"ruddr_last_sequence" + v:                                            "6",
+		"ruddr_last_pts_seconds" + v:                                         "5",
+		"ruddr_stored_fragments" + v:                                         "6",
+		"ruddr_stored_bytes" + v:                                             fmt.Sprint(len(testSource(6, 2)) - len(testInit())),
+		"ruddr_evicted_fragments_total" + v:                                  "0",
+		"ruddr_served_bytes_total" + v:                                       fmt.Sprint(served),
+		"ruddr_sendfile_errors_total" + v:                                    "0",
+		`ruddr_requests_total{channel="test",representation="v",code="200"}`: "2",
+		`ruddr_requests_total{channel="test",representation="v",code="404"}`: "1",
+		`ruddr_sse_clients{channel="test"}`:                                  "0",
+		`ruddr_sse_dropped_events_total{channel="test"}`:                     "0",
+		`ruddr_cmcd_requests_total{channel="test"}`:                          "2",
+		`ruddr_cmcd_stalls_total{channel="test"}`:                            "1",
+		`ruddr_cmcd_sessions{channel="test"}`:                                "2",
+		`ruddr_cmcd_starved_sessions{channel="test"}`:                        "1",
+		`ruddr_cmcd_buffer_length_seconds{channel="test"}`:                   "5",
+		"ruddr_cmcd_representation_sessions" + v:                             "2",
+	} {
+		if value, ok := samples[series]; !ok || value != expected {
+			t.Errorf("%s %s, expected %s", series, value, expected)
+		}
+	}
+	if lag, ok := samples["ruddr_ingest_lag_seconds"+v]; !ok || strings.HasPrefix(lag, "-") {
+		t.Errorf("ruddr_ingest_lag_seconds %s", lag)
+	}
+}
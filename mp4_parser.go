@@ -2,6 +2,9 @@ package main
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
 )
 
 type MP4Parser struct {
@@ -11,46 +14,61 @@ type MP4Parser struct {
 
 type Atom struct {
 	Type string
-	Size uint32
+	Size uint64 // including the header, 8 or 16 bytes with largesize
 	Data []byte
 }
 
 const (
-	IS_SYNC_SAMPLE = 0x02000000 // bit 25: sample is a sync sample (I-frame)
+	IS_SYNC_SAMPLE     = 0x02000000 // bit 25: sample is a sync sample (I-frame)
+	SAMPLE_IS_NON_SYNC = 0x00010000 // bit 16: sample_is_non_sync_sample
+	MAX_RUN_SAMPLES    = 1 << 20    // samples of a trun relying on the tfhd defaults only, 10 s of 48 kHz PCM fit easily
 )
 
+var (
+	ErrBoxTruncated   = errors.New("box truncated")
+	ErrBoxInvalidSize = errors.New("invalid box size")
+	ErrBoxNotFound    = errors.New("box not found")
+	ErrNoTrack        = errors.New("no track with the requested handler")
+	ErrUnsupported    = errors.New("unsupported box layout")
+)
+
+// BoxError tells which box could not be parsed and why, the cause is one of the ErrBox* errors
+type BoxError struct {
+	Type   string
+	Offset int
+	Err    error
+}
+
+func (e *BoxError) Error() string {
+	return fmt.Sprintf("box %q at offset %d: %v", e.Type, e.Offset, e.Err)
+}
+
+func (e *BoxError) Unwrap() error {
+	return e.Err
+}
+
 func NewMP4Parser(moovData, moofData []byte) *MP4Parser {
 	return &MP4Parser{moovData: moovData, moofData: moofData}
 }
 
-func (p *MP4Parser) IsIFrame() bool {
-	if len(p.moofData) == 0 {
-		return false
-	}
-
-	moofAtom, _ := p.findAtom(p.moofData, "moof")
-	if moofAtom.Type == "" {
-		return false
-	}
-	trafAtom, _ := p.findAtom(moofAtom.Data, "traf")
-	if trafAtom.Type == "" {
-		return false
+func (p *MP4Parser) IsIFrame() (bool, error) {
+	trafAtom, err := p.findPath(p.moofData, "moof", "traf")
+	if err != nil {
+		return false, err
 	}
 
 	// Check tfhd (Track Fragment Header) for default sample flags
-	tfhdAtom, _ := p.findAtom(trafAtom.Data, "tfhd")
-	if tfhdAtom.Type != "" && p.checkTfhdSyncFlag(tfhdAtom.Data) {
-		return true
+	if tfhdAtom, err := p.findAtom(trafAtom.Data, "tfhd"); err == nil && p.checkTfhdSyncFlag(tfhdAtom.Data) {
+		return true, nil
 	}
 
 	// Check trun (Track Fragment Run) for sample-specific flags
 	// Plus sanity check
-	trunAtom, _ := p.findAtom(trafAtom.Data, "trun")
-	if trunAtom.Type != "" && p.checkTrunSyncFlag(trunAtom.Data) {
-		return true
+	if trunAtom, err := p.findAtom(trafAtom.Data, "trun"); err == nil && p.checkTrunSyncFlag(trunAtom.Data) {
+		return true, nil
 	}
 
-	return false
+	return false, nil
 }
 
 func (p *MP4Parser) checkTfhdSyncFlag(tfhdData []byte) bool {
@@ -163,90 +181,684 @@ func (p *MP4Parser) checkTrunSyncFlag(trunData []byte) bool {
 	return false
 }
 
-func (p *MP4Parser) GetVideoTimescale() uint32 {
-	moovAtom, _ := p.findAtom(p.moovData, "moov")
-	trakAtoms := p.findAllAtoms(moovAtom.Data, "trak")
+// GetHandlerType returns the handler of the first audio or video track ("vide", "soun")
+func (p *MP4Parser) GetHandlerType() (string, error) {
+	trakAtoms, err := p.findTracks()
+	if err != nil {
+		return "", err
+	}
+	for _, trakAtom := range trakAtoms {
+		handlerType, err := p.getHandler(trakAtom)
+		if err != nil {
+			return "", err
+		}
+		if handlerType == "vide" || handlerType == "soun" {
+			return handlerType, nil
+		}
+	}
+	return "", ErrNoTrack
+}
 
+// GetTimescale returns the media timescale of the first track with the given handler
+func (p *MP4Parser) GetTimescale(handlerType string) (uint32, error) {
+	trakAtom, err := p.findTrack(handlerType)
+	if err != nil {
+		return 0, err
+	}
+	mdhdAtom, err := p.findPath(trakAtom.Data, "mdia", "mdhd")
+	if err != nil {
+		return 0, err
+	}
+	if len(mdhdAtom.Data) < 1 {
+		return 0, &BoxError{Type: "mdhd", Err: ErrBoxTruncated}
+	}
+	version := mdhdAtom.Data[0]
+	var timescale uint32
+	if version == 1 && len(mdhdAtom.Data) >= 24 {
+		timescale = binary.BigEndian.Uint32(mdhdAtom.Data[20:24])
+	} else if version == 0 && len(mdhdAtom.Data) >= 16 {
+		timescale = binary.BigEndian.Uint32(mdhdAtom.Data[12:16])
+	} else {
+		return 0, &BoxError{Type: "mdhd", Err: ErrBoxTruncated}
+	}
+	if timescale == 0 {
+		return 0, &BoxError{Type: "mdhd", Err: errors.New("zero timescale")}
+	}
+	return timescale, nil
+}
+
+func (p *MP4Parser) GetVideoTimescale() (uint32, error) {
+	return p.GetTimescale("vide")
+}
+
+// GetAudioInfo reads sample rate and channel count from the audio sample entry and the bitrate from esds, if any
+func (p *MP4Parser) GetAudioInfo() (sampleRate uint32, channels uint16, bitrate uint32, err error) {
+	entry, err := p.GetSampleEntry("soun")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	// reserved(6) data_reference_index(2) reserved(8) channelcount(2) samplesize(2) pre_defined(2) reserved(2) samplerate(4)
+	if len(entry.Data) < 28 {
+		return 0, 0, 0, &BoxError{Type: entry.Type, Err: ErrBoxTruncated}
+	}
+	channels = binary.BigEndian.Uint16(entry.Data[16:18])
+	sampleRate = binary.BigEndian.Uint32(entry.Data[24:28]) >> 16
+
+	if esdsAtom, err := p.findAtom(entry.Data[28:], "esds"); err == nil && len(esdsAtom.Data) > 4 {
+		if config := findDescriptor(esdsAtom.Data[4:], 0x04); len(config) >= 13 {
+			// objectTypeIndication(1) streamType(1) bufferSizeDB(3) maxBitrate(4) avgBitrate(4)
+			bitrate = binary.BigEndian.Uint32(config[9:13])
+			if bitrate == 0 {
+				bitrate = binary.BigEndian.Uint32(config[5:9])
+			}
+		}
+	}
+	if dOpsAtom, err := p.findAtom(entry.Data[28:], "dOps"); err == nil && len(dOpsAtom.Data) >= 8 {
+		// Version(1) OutputChannelCount(1) PreSkip(2) InputSampleRate(4)
+		channels = uint16(dOpsAtom.Data[1])
+		sampleRate = binary.BigEndian.Uint32(dOpsAtom.Data[4:8])
+	}
+	return sampleRate, channels, bitrate, nil
+}
+
+// GetSampleEntry returns the first sample entry of the stsd of the first track with the given handler,
+// its Type is the codec fourcc (avc1, hvc1, mp4a, ...)
+func (p *MP4Parser) GetSampleEntry(handlerType string) (Atom, error) {
+	trakAtom, err := p.findTrack(handlerType)
+	if err != nil {
+		return Atom{}, err
+	}
+	stsdAtom, err := p.findPath(trakAtom.Data, "mdia", "minf", "stbl", "stsd")
+	if err != nil {
+		return Atom{}, err
+	}
+	// version+flags(4) entry_count(4)
+	if len(stsdAtom.Data) < 8 {
+		return Atom{}, &BoxError{Type: "stsd", Err: ErrBoxTruncated}
+	}
+	entry, _, err := p.readAtom(stsdAtom.Data, 8)
+	return entry, err
+}
+
+// GetCodec returns the sample entry fourcc of the video track (avc1, avc3, hvc1, hev1, av01), or of the audio one
+func (p *MP4Parser) GetCodec() (string, error) {
+	entry, err := p.GetSampleEntry("vide")
+	if errors.Is(err, ErrNoTrack) {
+		entry, err = p.GetSampleEntry("soun")
+	}
+	return entry.Type, err
+}
+
+// GetCodecString builds the RFC 6381 codecs parameter (avc1.64001f, hvc1.1.6.L120.90, av01.0.08M.08, mp4a.40.2)
+// from the decoder configuration record of the sample entry
+// missing or unknown configuration records fall back to the bare fourcc
+func (p *MP4Parser) GetCodecString() (string, error) {
+	handlerType := "vide"
+	entry, err := p.GetSampleEntry(handlerType)
+	if errors.Is(err, ErrNoTrack) {
+		handlerType = "soun"
+		entry, err = p.GetSampleEntry(handlerType)
+	}
+	if err != nil {
+		return "", err
+	}
+	children := sampleEntryChildren(entry, handlerType)
+
+	switch entry.Type {
+	case "avc1", "avc3":
+		// configurationVersion(1) AVCProfileIndication(1) profile_compatibility(1) AVCLevelIndication(1)
+		if avcC, err := p.findAtom(children, "avcC"); err == nil && len(avcC.Data) >= 4 {
+			return fmt.Sprintf("%s.%02x%02x%02x", entry.Type, avcC.Data[1], avcC.Data[2], avcC.Data[3]), nil
+		}
+	case "hvc1", "hev1":
+		// configurationVersion(1) profile_space(2) tier_flag(1) profile_idc(5) compatibility_flags(32) constraint_flags(48) level_idc(8)
+		if hvcC, err := p.findAtom(children, "hvcC"); err == nil && len(hvcC.Data) >= 13 {
+			profileSpace := []string{"", "A", "B", "C"}[hvcC.Data[1]>>6]
+			tier := "L"
+			if hvcC.Data[1]&0x20 != 0 {
+				tier = "H"
+			}
+			compatibility := bits.Reverse32(binary.BigEndian.Uint32(hvcC.Data[2:6]))
+			codec := fmt.Sprintf("%s.%s%d.%x.%s%d", entry.Type, profileSpace, hvcC.Data[1]&0x1F, compatibility, tier, hvcC.Data[12])
+			// constraint bytes, trailing zero bytes omitted
+			constraints := hvcC.Data[6:12]
+			for len(constraints) > 0 && constraints[len(constraints)-1] == 0 {
+				constraints = constraints[:len(constraints)-1]
+			}
+			for _, b := range constraints {
+				codec += fmt.Sprintf(".%x", b)
+			}
+			return codec, nil
+		}
+	case "av01":
+		// marker+version(1), then seq_profile(3) seq_level_idx_0(5) seq_tier_0(1) high_bitdepth(1) twelve_bit(1) ...
+		if av1C, err := p.findAtom(children, "av1C"); err == nil && len(av1C.Data) >= 3 {
+			tier := "M"
+			if av1C.Data[2]&0x80 != 0 {
+				tier = "H"
+			}
+			bitDepth := 8
+			if av1C.Data[2]&0x40 != 0 {
+				bitDepth = 10
+				if av1C.Data[1]>>5 == 2 && av1C.Data[2]&0x20 != 0 {
+					bitDepth = 12
+				}
+			}
+			return fmt.Sprintf("av01.%d.%02d%s.%02d", av1C.Data[1]>>5, av1C.Data[1]&0x1F, tier, bitDepth), nil
+		}
+	case "mp4a":
+		if esds, err := p.findAtom(children, "esds"); err == nil && len(esds.Data) > 4 {
+			decoderConfig := findDescriptor(esds.Data[4:], 0x04)
+			if len(decoderConfig) == 0 {
+				break
+			}
+			if decoderConfig[0] != 0x40 { // not MPEG-4 audio, the object type is enough
+				return fmt.Sprintf("mp4a.%02x", decoderConfig[0]), nil
+			}
+			// AudioSpecificConfig: audioObjectType(5), 31 escapes to 32 + 6 more bits
+			if specific := findDescriptor(esds.Data[4:], 0x05); len(specific) >= 1 {
+				objectType := int(specific[0] >> 3)
+				if objectType == 31 && len(specific) >= 2 {
+					objectType = 32 + int(specific[0]&0x07)<<3 + int(specific[1]>>5)
+				}
+				return fmt.Sprintf("mp4a.40.%d", objectType), nil
+			}
+			return "mp4a.40", nil
+		}
+	case "Opus":
+		return "opus", nil
+	}
+	return entry.Type, nil
+}
+
+// GetPixelAspectRatio returns the pasp ratio of the video sample entry, 1:1 when absent
+func (p *MP4Parser) GetPixelAspectRatio() (uint32, uint32) {
+	entry, _ := p.GetSampleEntry("vide")
+	pasp, err := p.findAtom(sampleEntryChildren(entry, "vide"), "pasp")
+	if err != nil || len(pasp.Data) < 8 || binary.BigEndian.Uint32(pasp.Data[4:8]) == 0 {
+		return 1, 1
+	}
+	return binary.BigEndian.Uint32(pasp.Data[0:4]), binary.BigEndian.Uint32(pasp.Data[4:8])
+}
+
+// GetColorInfo returns the nclx colour description of the video sample entry, nil when absent
+func (p *MP4Parser) GetColorInfo() *ColorInfo {
+	entry, _ := p.GetSampleEntry("vide")
+	colr, err := p.findAtom(sampleEntryChildren(entry, "vide"), "colr")
+	// colour_type(4) colour_primaries(2) transfer_characteristics(2) matrix_coefficients(2) full_range_flag(1)
+	if err != nil || len(colr.Data) < 11 || string(colr.Data[0:4]) != "nclx" {
+		return nil
+	}
+	return &ColorInfo{
+		Primaries: binary.BigEndian.Uint16(colr.Data[4:6]),
+		Transfer:  binary.BigEndian.Uint16(colr.Data[6:8]),
+		Matrix:    binary.BigEndian.Uint16(colr.Data[8:10]),
+		FullRange: colr.Data[10]&0x80 != 0,
+	}
+}
+
+// GetSampleCount returns the number of samples in the fragment trun
+func (p *MP4Parser) GetSampleCount() (uint32, error) {
+	trunAtom, err := p.findPath(p.moofData, "moof", "traf", "trun")
+	if err != nil {
+		return 0, err
+	}
+	if len(trunAtom.Data) < 8 {
+		return 0, &BoxError{Type: "trun", Err: ErrBoxTruncated}
+	}
+	return binary.BigEndian.Uint32(trunAtom.Data[4:8]), nil
+}
+
+// boxes following the fixed fields of a visual (78 bytes) or audio (28 bytes) sample entry
+func sampleEntryChildren(entry Atom, handlerType string) []byte {
+	fixed := 28
+	if handlerType == "vide" {
+		fixed = 78
+	}
+	if len(entry.Data) < fixed {
+		return nil
+	}
+	return entry.Data[fixed:]
+}
+
+func (p *MP4Parser) findTrack(handlerType string) (Atom, error) {
+	trakAtoms, err := p.findTracks()
+	if err != nil {
+		return Atom{}, err
+	}
 	for _, trakAtom := range trakAtoms {
-		mdiaAtom, _ := p.findAtom(trakAtom.Data, "mdia")
-		hdlrAtom, _ := p.findAtom(mdiaAtom.Data, "hdlr")
-		handlerType := string(hdlrAtom.Data[8:12])
-		if handlerType == "vide" {
-			mdhdAtom, _ := p.findAtom(mdiaAtom.Data, "mdhd")
-			version := mdhdAtom.Data[0]
-			var timescale uint32
-			if version == 1 {
-				timescale = binary.BigEndian.Uint32(mdhdAtom.Data[20:24])
-			} else {
-				timescale = binary.BigEndian.Uint32(mdhdAtom.Data[12:16])
+		handler, err := p.getHandler(trakAtom)
+		if err != nil {
+			return Atom{}, err
+		}
+		if handler == handlerType {
+			return trakAtom, nil
+		}
+	}
+	return Atom{}, ErrNoTrack
+}
+
+func (p *MP4Parser) findTracks() ([]Atom, error) {
+	moovAtom, err := p.findAtom(p.moovData, "moov")
+	if err != nil {
+		return nil, err
+	}
+	return p.findAllAtoms(moovAtom.Data, "trak")
+}
+
+// handler_type of the trak, from mdia/hdlr: version+flags(4) pre_defined(4) handler_type(4)
+func (p *MP4Parser) getHandler(trakAtom Atom) (string, error) {
+	hdlrAtom, err := p.findPath(trakAtom.Data, "mdia", "hdlr")
+	if err != nil {
+		return "", err
+	}
+	if len(hdlrAtom.Data) < 12 {
+		return "", &BoxError{Type: "hdlr", Err: ErrBoxTruncated}
+	}
+	return string(hdlrAtom.Data[8:12]), nil
+}
+
+// findDescriptor walks MPEG-4 descriptors (ES_Descriptor and its children) looking for the given tag
+func findDescriptor(data []byte, tag byte) []byte {
+	offset := 0
+	for offset < len(data) {
+		descriptorTag := data[offset]
+		offset++
+		// size is coded on up to 4 bytes, 7 bits each, msb flags continuation
+		size := 0
+		for i := 0; i < 4 && offset < len(data); i++ {
+			b := data[offset]
+			offset++
+			size = size<<7 | int(b&0x7f)
+			if b&0x80 == 0 {
+				break
 			}
-			return timescale
 		}
+		if offset+size > len(data) {
+			return nil
+		}
+		body := data[offset : offset+size]
+		if descriptorTag == tag {
+			return body
+		}
+		switch descriptorTag {
+		case 0x03: // ES_Descriptor: ES_ID(2) flags(1) [dependsOn_ES_ID(2)] [URL] [OCR_ES_Id(2)]
+			if len(body) < 3 {
+				return nil
+			}
+			flags := body[2]
+			skip := 3
+			if flags&0x80 != 0 {
+				skip += 2
+			}
+			if flags&0x40 != 0 && skip < len(body) {
+				skip += 1 + int(body[skip])
+			}
+			if flags&0x20 != 0 {
+				skip += 2
+			}
+			if skip <= len(body) {
+				if found := findDescriptor(body[skip:], tag); found != nil {
+					return found
+				}
+			}
+		case 0x04: // DecoderConfigDescriptor: 13 bytes before the DecoderSpecificInfo
+			if len(body) > 13 {
+				if found := findDescriptor(body[13:], tag); found != nil {
+					return found
+				}
+			}
+		}
+		offset += size
 	}
-	return 0 // Return 0 if no video track is found
+	return nil
 }
 
-func (p *MP4Parser) GetPTS(timescale uint32) float32 {
-	moofAtom, _ := p.findAtom(p.moofData, "moof")
-	trafAtom, _ := p.findAtom(moofAtom.Data, "traf")
-	tfdtAtom, _ := p.findAtom(trafAtom.Data, "tfdt")
+// GetDecodeTime returns the tfdt baseMediaDecodeTime, in timescale units
+func (p *MP4Parser) GetDecodeTime() (uint64, error) {
+	tfdtAtom, err := p.findPath(p.moofData, "moof", "traf", "tfdt")
+	if err != nil {
+		return 0, err
+	}
+	if len(tfdtAtom.Data) < 8 {
+		return 0, &BoxError{Type: "tfdt", Err: ErrBoxTruncated}
+	}
 
 	version := tfdtAtom.Data[0]
 	var baseMediaDecodeTime uint64
 	if version == 1 {
+		if len(tfdtAtom.Data) < 12 {
+			return 0, &BoxError{Type: "tfdt", Err: ErrBoxTruncated}
+		}
 		baseMediaDecodeTime = binary.BigEndian.Uint64(tfdtAtom.Data[4:12])
 	} else {
 		baseMediaDecodeTime = uint64(binary.BigEndian.Uint32(tfdtAtom.Data[4:8]))
 	}
 
-	pts := float32(baseMediaDecodeTime) / float32(timescale)
-	return pts
+	return baseMediaDecodeTime, nil
+}
+
+// GetDuration returns the duration of the fragment in timescale units, summing up the trun sample durations
+func (p *MP4Parser) GetDuration() (uint64, error) {
+	trafAtom, err := p.findPath(p.moofData, "moof", "traf")
+	if err != nil {
+		return 0, err
+	}
+	tfhdAtom, _ := p.findAtom(trafAtom.Data, "tfhd") // optional, defaults come from trex otherwise
+	trunAtom, err := p.findAtom(trafAtom.Data, "trun")
+	if err != nil {
+		return 0, err
+	}
+	if len(trunAtom.Data) < 8 {
+		return 0, &BoxError{Type: "trun", Err: ErrBoxTruncated}
+	}
+
+	defaultDuration := p.getDefaultSampleDuration(tfhdAtom.Data)
+
+	flags := binary.BigEndian.Uint32(trunAtom.Data[0:4]) & 0x00FFFFFF
+	sampleCount := binary.BigEndian.Uint32(trunAtom.Data[4:8])
+	if flags&0x000100 == 0 { // every sample lasts the default duration
+		return uint64(sampleCount) * uint64(defaultDuration), nil
+	}
+
+	offset := 8
+	if flags&0x000001 != 0 { // data_offset present
+		offset += 4
+	}
+	if flags&0x000004 != 0 { // first_sample_flags present
+		offset += 4
+	}
+	sampleEntrySize := 4 // sample_duration
+	for _, flag := range []uint32{0x000200, 0x000400, 0x000800} {
+		if flags&flag != 0 {
+			sampleEntrySize += 4
+		}
+	}
+
+	duration := uint64(0)
+	for i := uint32(0); i < sampleCount && offset+4 <= len(trunAtom.Data); i++ {
+		duration += uint64(binary.BigEndian.Uint32(trunAtom.Data[offset : offset+4]))
+		offset += sampleEntrySize
+	}
+	return duration, nil
+}
+
+// default-sample-duration from tfhd, falling back to the trex defaults in moov
+func (p *MP4Parser) getDefaultSampleDuration(tfhdData []byte) uint32 {
+	duration, _, _ := p.getSampleDefaults(tfhdData)
+	return duration
+}
+
+// default sample duration, size and flags from tfhd, each falling back to the trex defaults in moov
+func (p *MP4Parser) getSampleDefaults(tfhdData []byte) (duration, size, flags uint32) {
+	trexAtom, err := p.findPath(p.moovData, "moov", "mvex", "trex")
+	// version+flags(4) track_ID(4) default_sample_description_index(4) default_sample_duration(4) default_sample_size(4) default_sample_flags(4)
+	if err == nil && len(trexAtom.Data) >= 24 {
+		duration = binary.BigEndian.Uint32(trexAtom.Data[12:16])
+		size = binary.BigEndian.Uint32(trexAtom.Data[16:20])
+		flags = binary.BigEndian.Uint32(trexAtom.Data[20:24])
+	} else if err == nil && len(trexAtom.Data) >= 16 {
+		duration = binary.BigEndian.Uint32(trexAtom.Data[12:16])
+	}
+
+	if len(tfhdData) < 8 {
+		return
+	}
+	tfhdFlags := binary.BigEndian.Uint32(tfhdData[0:4]) & 0x00FFFFFF
+	offset := 8                  // Skip version+flags(4) + track_ID(4)
+	if tfhdFlags&0x000001 != 0 { // base-data-offset present
+		offset += 8
+	}
+	if tfhdFlags&0x000002 != 0 { // sample-description-index present
+		offset += 4
+	}
+	for _, field := range []struct {
+		flag  uint32
+		value *uint32
+	}{{0x000008, &duration}, {0x000010, &size}, {0x000020, &flags}} {
+		if tfhdFlags&field.flag == 0 {
+			continue
+		}
+		if offset+4 <= len(tfhdData) {
+			*field.value = binary.BigEndian.Uint32(tfhdData[offset : offset+4])
+		}
+		offset += 4
+	}
+	return
+}
+
+// Sample is a trun entry with the tfhd and trex defaults applied
+type Sample struct {
+	Duration          uint32
+	Size              uint32
+	Flags             uint32
+	CompositionOffset int32
+}
+
+// Sync tells whether the sample can be decoded on its own
+func (s Sample) Sync() bool {
+	return s.Flags&SAMPLE_IS_NON_SYNC == 0
+}
+
+// TrackRun is a trun, its samples are stored contiguously from DataOffset (relative to the start of the moof)
+type TrackRun struct {
+	DataOffset uint64
+	Samples    []Sample
+}
+
+// GetTrackRuns lists the samples of every trun of the fragment
+func (p *MP4Parser) GetTrackRuns() ([]TrackRun, error) {
+	trafAtom, err := p.findPath(p.moofData, "moof", "traf")
+	if err != nil {
+		return nil, err
+	}
+	tfhdAtom, err := p.findAtom(trafAtom.Data, "tfhd")
+	if err != nil {
+		return nil, err
+	}
+	if len(tfhdAtom.Data) >= 4 && binary.BigEndian.Uint32(tfhdAtom.Data[0:4])&0x000001 != 0 {
+		// an absolute base-data-offset refers to the original file, not to the moof
+		return nil, &BoxError{Type: "tfhd", Err: ErrUnsupported}
+	}
+	defaultDuration, defaultSize, defaultFlags := p.getSampleDefaults(tfhdAtom.Data)
+	trunAtoms, err := p.findAllAtoms(trafAtom.Data, "trun")
+	if err != nil {
+		return nil, err
+	}
+	if len(trunAtoms) == 0 {
+		return nil, &BoxError{Type: "trun", Err: ErrBoxNotFound}
+	}
+
+	runs := make([]TrackRun, 0, len(trunAtoms))
+	next := uint64(0) // a trun without data_offset continues where the previous one ended
+	for _, trunAtom := range trunAtoms {
+		data := trunAtom.Data
+		if len(data) < 8 {
+			return nil, &BoxError{Type: "trun", Err: ErrBoxTruncated}
+		}
+		flags := binary.BigEndian.Uint32(data[0:4]) & 0x00FFFFFF
+		sampleCount := binary.BigEndian.Uint32(data[4:8])
+		offset := 8
+
+		run := TrackRun{DataOffset: next}
+		if flags&0x000001 != 0 { // data_offset present
+			if offset+4 > len(data) {
+				return nil, &BoxError{Type: "trun", Err: ErrBoxTruncated}
+			}
+			run.DataOffset = uint64(int64(int32(binary.BigEndian.Uint32(data[offset : offset+4]))))
+			offset += 4
+		}
+		firstFlags, hasFirstFlags := uint32(0), flags&0x000004 != 0
+		if hasFirstFlags {
+			if offset+4 > len(data) {
+				return nil, &BoxError{Type: "trun", Err: ErrBoxTruncated}
+			}
+			firstFlags = binary.BigEndian.Uint32(data[offset : offset+4])
+			offset += 4
+		}
+
+		sampleEntrySize := 0
+		for _, flag := range []uint32{0x000100, 0x000200, 0x000400, 0x000800} {
+			if flags&flag != 0 {
+				sampleEntrySize += 4
+			}
+		}
+		if uint64(len(data)-offset) < uint64(sampleCount)*uint64(sampleEntrySize) {
+			return nil, &BoxError{Type: "trun", Err: ErrBoxTruncated}
+		}
+		if sampleEntrySize == 0 && sampleCount > MAX_RUN_SAMPLES {
+			// nothing per sample to bound the count with, the box would still allocate them all
+			return nil, &BoxError{Type: "trun", Err: ErrBoxInvalidSize}
+		}
+
+		run.Samples = make([]Sample, sampleCount)
+		size := uint64(0)
+		for i := range run.Samples {
+			sample := Sample{Duration: defaultDuration, Size: defaultSize, Flags: defaultFlags}
+			if i == 0 && hasFirstFlags {
+				sample.Flags = firstFlags
+			}
+			if flags&0x000100 != 0 { // sample_duration
+				sample.Duration = binary.BigEndian.Uint32(data[offset : offset+4])
+				offset += 4
+			}
+			if flags&0x000200 != 0 { // sample_size
+				sample.Size = binary.BigEndian.Uint32(data[offset : offset+4])
+				offset += 4
+			}
+			if flags&0x000400 != 0 { // sample_flags
+				sample.Flags = binary.BigEndian.Uint32(data[offset : offset+4])
+				offset += 4
+			}
+			if flags&0x000800 != 0 { // sample_composition_time_offset, signed in version 1
+				sample.CompositionOffset = int32(binary.BigEndian.Uint32(data[offset : offset+4]))
+				offset += 4
+			}
+			run.Samples[i] = sample
+			size += uint64(sample.Size)
+		}
+		next = run.DataOffset + size
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+// GetTrackID returns the track the fragment belongs to
+func (p *MP4Parser) GetTrackID() (uint32, error) {
+	tfhdAtom, err := p.findPath(p.moofData, "moof", "traf", "tfhd")
+	if err != nil {
+		return 0, err
+	}
+	if len(tfhdAtom.Data) < 8 {
+		return 0, &BoxError{Type: "tfhd", Err: ErrBoxTruncated}
+	}
+	return binary.BigEndian.Uint32(tfhdAtom.Data[4:8]), nil
 }
 
-func (p *MP4Parser) GetSequenceNumber() uint32 {
-	moofAtom, _ := p.findAtom(p.moofData, "moof")
-	mfhdAtom, _ := p.findAtom(moofAtom.Data, "mfhd")
+func (p *MP4Parser) GetSequenceNumber() (uint32, error) {
+	mfhdAtom, err := p.findPath(p.moofData, "moof", "mfhd")
+	if err != nil {
+		return 0, err
+	}
+	if len(mfhdAtom.Data) < 8 {
+		return 0, &BoxError{Type: "mfhd", Err: ErrBoxTruncated}
+	}
 	sequenceNumber := binary.BigEndian.Uint32(mfhdAtom.Data[4:8])
-	return sequenceNumber
+	return sequenceNumber, nil
 }
 
-func (p *MP4Parser) GetResolution() (uint32, uint32) {
-	moovAtom, _ := p.findAtom(p.moovData, "moov")
-	trakAtom, _ := p.findAtom(moovAtom.Data, "trak")
-	tkhdAtom, _ := p.findAtom(trakAtom.Data, "tkhd")
-	width := binary.BigEndian.Uint32(tkhdAtom.Data[76:80]) >> 16
-	height := binary.BigEndian.Uint32(tkhdAtom.Data[80:84]) >> 16
-	return width, height
+func (p *MP4Parser) GetResolution() (uint32, uint32, error) {
+	trakAtom, err := p.findTrack("vide")
+	if err != nil {
+		return 0, 0, err
+	}
+	tkhdAtom, err := p.findAtom(trakAtom.Data, "tkhd")
+	if err != nil {
+		return 0, 0, err
+	}
+	// width and height are the last fields, after 64 bit times in version 1
+	offset := 76
+	if len(tkhdAtom.Data) > 0 && tkhdAtom.Data[0] == 1 {
+		offset = 88
+	}
+	if len(tkhdAtom.Data) < offset+8 {
+		return 0, 0, &BoxError{Type: "tkhd", Err: ErrBoxTruncated}
+	}
+	width := binary.BigEndian.Uint32(tkhdAtom.Data[offset:offset+4]) >> 16
+	height := binary.BigEndian.Uint32(tkhdAtom.Data[offset+4:offset+8]) >> 16
+	return width, height, nil
 }
 
-func (p *MP4Parser) findAtom(data []byte, atomType string) (Atom, int) {
+// findAtom returns the first child of the given type, ErrBoxNotFound if there is none
+func (p *MP4Parser) findAtom(data []byte, atomType string) (Atom, error) {
 	offset := 0
 	for offset < len(data) {
-		atom, nextOffset := p.readAtom(data, offset)
+		atom, nextOffset, err := p.readAtom(data, offset)
+		if err != nil {
+			return Atom{}, err
+		}
 		if atom.Type == atomType {
-			return atom, nextOffset
+			return atom, nil
 		}
 		offset = nextOffset
 	}
-	return Atom{}, -1
+	return Atom{}, &BoxError{Type: atomType, Offset: offset, Err: ErrBoxNotFound}
+}
+
+// findPath descends the box tree one type at a time, e.g. "moof", "traf", "tfdt"
+func (p *MP4Parser) findPath(data []byte, path ...string) (Atom, error) {
+	atom := Atom{Data: data}
+	for _, atomType := range path {
+		var err error
+		if atom, err = p.findAtom(atom.Data, atomType); err != nil {
+			return Atom{}, err
+		}
+	}
+	return atom, nil
 }
 
-func (p *MP4Parser) readAtom(data []byte, offset int) (Atom, int) {
-	size := binary.BigEndian.Uint32(data[offset : offset+4])
+// readAtom reads the box header at offset, supporting 64 bit largesize (size 1) and boxes extending to the end (size 0)
+func (p *MP4Parser) readAtom(data []byte, offset int) (Atom, int, error) {
+	if offset < 0 || offset > len(data)-8 { // offset+8 would wrap around for offsets close to MaxInt
+		return Atom{}, 0, &BoxError{Offset: offset, Err: ErrBoxTruncated}
+	}
+	size := uint64(binary.BigEndian.Uint32(data[offset : offset+4]))
 	atomType := string(data[offset+4 : offset+8])
-	atomData := data[offset+8 : offset+int(size)]
-	return Atom{Type: atomType, Size: size, Data: atomData}, offset + int(size)
+	headerSize := uint64(8)
+
+	switch size {
+	case 0: // box extends to the end of the enclosing data
+		size = uint64(len(data) - offset)
+	case 1: // largesize follows the type
+		if offset+16 > len(data) {
+			return Atom{}, 0, &BoxError{Type: atomType, Offset: offset, Err: ErrBoxTruncated}
+		}
+		size = binary.BigEndian.Uint64(data[offset+8 : offset+16])
+		headerSize = 16
+	}
+
+	if size < headerSize {
+		return Atom{}, 0, &BoxError{Type: atomType, Offset: offset, Err: ErrBoxInvalidSize}
+	}
+	if size > uint64(len(data)-offset) {
+		return Atom{}, 0, &BoxError{Type: atomType, Offset: offset, Err: ErrBoxTruncated}
+	}
+	atomData := data[offset+int(headerSize) : offset+int(size)]
+	return Atom{Type: atomType, Size: size, Data: atomData}, offset + int(size), nil
 }
 
-func (p *MP4Parser) findAllAtoms(data []byte, atomType string) []Atom {
+func (p *MP4Parser) findAllAtoms(data []byte, atomType string) ([]Atom, error) {
 	var atoms []Atom
 	offset := 0
 	for offset < len(data) {
-		atom, nextOffset := p.readAtom(data, offset)
+		atom, nextOffset, err := p.readAtom(data, offset)
+		if err != nil {
+			return nil, err
+		}
 		if atom.Type == atomType {
 			atoms = append(atoms, atom)
 		}
 		offset = nextOffset
 	}
-	return atoms
+	return atoms, nil
 }
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"testing"
+)
+
+// the fuzzers log every invalid box, the logs of the tests are not read
+func TestMain(m *testing.M) {
+	logOutput = io.Discard
+	mainLog = slog.New(slog.NewTextHandler(io.Discard, nil))
+	config.Store(&Config{})
+	os.Exit(m.Run())
+}
+
+// same box as makeBox with a 64 bit largesize header
+func makeLargeBox(atomType string, payload ...[]byte) []byte {
+	b := bytes.Join(payload, nil)
+	return append(makeBoxHeader(atomType, uint64(len(b)), true), b...)
+}
+
+func u16(v uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, v)
+}
+
+const (
+	TEST_TIMESCALE       = 90000
+	TEST_SAMPLE_DURATION = 3000 // 30 fps
+	TEST_SAMPLES         = 30   // one second fragments
+)
+
+// ftyp and moov of a 1280x720 H.264 track
+func testInit() []byte {
+	return append(makeBox("ftyp", []byte("iso5"), u32(0), []byte("iso5iso6mp41")), testMoov()...)
+}
+
+func testMoov() []byte {
+	avcC := makeBox("avcC", []byte{1, 0x64, 0, 0x1f, 0xff, 0xe1}, u16(4), []byte{0x67, 0x64, 0x00, 0x1f}, []byte{1}, u16(4), []byte{0x68, 0xee, 0x3c, 0x80})
+	return testTrackMoov("vide", TEST_TIMESCALE, testVisualEntry("avc1", avcC, makeBox("pasp", u32(1), u32(1))))
+}
+
+// moov of a single track with the given handler (vide, soun) and sample entry
+func testTrackMoov(handlerType string, timescale uint32, entry []byte) []byte {
+	mvhd := makeFullBox("mvhd", 0, 0, u32(0), u32(0), u32(1000), u32(0), make([]byte, 80))
+	tkhd := makeFullBox("tkhd", 0, 3, u32(0), u32(0), u32(1), u32(0), u32(0), make([]byte, 52), u32(1280<<16), u32(720<<16))
+	mdhd := makeFullBox("mdhd", 0, 0, u32(0), u32(0), u32(timescale), u32(0), []byte{0x55, 0xc4, 0, 0})
+	hdlr := makeFullBox("hdlr", 0, 0, u32(0), []byte(handlerType), make([]byte, 12), []byte("x\x00"))
+	mediaHeader := makeFullBox("vmhd", 0, 1, make([]byte, 8))
+	if handlerType == "soun" {
+		mediaHeader = makeFullBox("smhd", 0, 0, make([]byte, 4))
+	}
+	stbl := makeBox("stbl", makeFullBox("stsd", 0, 0, u32(1), entry), makeFullBox("stts", 0, 0, u32(0)),
+		makeFullBox("stsc", 0, 0, u32(0)), makeFullBox("stsz", 0, 0, u32(0), u32(0)), makeFullBox("stco", 0, 0, u32(0)))
+	minf := makeBox("minf", mediaHeader, makeBox("dinf", makeFullBox("dref", 0, 0, u32(1), makeFullBox("url ", 0, 1))), stbl)
+	trak := makeBox("trak", tkhd, makeBox("mdia", mdhd, hdlr, minf))
+	mvex := makeBox("mvex", makeFullBox("trex", 0, 0, u32(1), u32(1), u32(0), u32(0), u32(0)))
+	return makeBox("moov", mvhd, trak, mvex)
+}
+
+// 1280x720 visual sample entry followed by the given boxes (decoder configuration, pasp, colr)
+func testVisualEntry(codec string, children ...[]byte) []byte {
+	fields := [][]byte{make([]byte, 6), u16(1), make([]byte, 16), u16(1280), u16(720), u32(0x480000), u32(0x480000),
+		u32(0), u16(1), make([]byte, 32), u16(0x18), u16(0xffff)}
+	return makeBox(codec, append(fields, children...)...)
+}
+
+// audio sample entry of 16 bit samples followed by the given boxes (esds, dOps)
+func testAudioEntry(codec string, channels uint16, sampleRate uint32, children ...[]byte) []byte {
+	fields := [][]byte{make([]byte, 6), u16(1), make([]byte, 8), u16(channels), u16(16), u16(0), u16(0), u32(sampleRate << 16)}
+	return makeBox(codec, append(fields, children...)...)
+}
+
+// esds of the given object type (0x40 MPEG-4 audio) and average bitrate, with an AudioSpecificConfig when specific is set
+func testEsds(objectType byte, bitrate uint32, specific ...byte) []byte {
+	decoderConfig := append([]byte{objectType, 0x15, 0, 0, 0}, append(u32(2*bitrate), u32(bitrate)...)...)
+	if len(specific) > 0 {
+		decoderConfig = append(decoderConfig, append([]byte{0x05, byte(len(specific))}, specific...)...)
+	}
+	es := append([]byte{0, 1, 0, 0x04, byte(len(decoderConfig))}, decoderConfig...)
+	es = append(es, 0x06, 1, 0x02)
+	return makeFullBox("esds", 0, 0, append([]byte{0x03, byte(len(es))}, es...))
+}
+
+// moof and mdat of one second of video starting at decode time dt, an IDR first when keyframe
+func testFragment(seq uint32, dt uint64, keyframe bool) []byte {
+	samples := make([][]byte, TEST_SAMPLES)
+	entries := []byte{}
+	for i := range samples {
+		nal := append([]byte{0x41}, bytes.Repeat([]byte{byte(seq + uint32(i))}, 8)...)
+		flags := uint32(SAMPLE_IS_NON_SYNC | 0x01000000)
+		if keyframe && i == 0 {
+			nal = append([]byte{0x65}, bytes.Repeat([]byte{byte(seq)}, 64)...)
+			flags = IS_SYNC_SAMPLE
+		}
+		samples[i] = append(u32(uint32(len(nal))), nal...)
+		entries = append(entries, append(u32(uint32(len(samples[i]))), u32(flags)...)...)
+	}
+	moof := func(dataOffset uint32) []byte {
+		trun := makeFullBox("trun", 0, 0x000001|0x000200|0x000400, u32(TEST_SAMPLES), u32(dataOffset), entries)
+		tfhd := makeFullBox("tfhd", 0, 0x020008, u32(1), u32(TEST_SAMPLE_DURATION))
+		tfdt := makeFullBox("tfdt", 1, 0, u64(dt))
+		return makeBox("moof", makeFullBox("mfhd", 0, 0, u32(seq)), makeBox("traf", tfhd, tfdt, trun))
+	}
+	m := moof(0)
+	m = moof(uint32(len(m) + 8))
+	return append(m, makeBox("mdat", samples...)...)
+}
+
+// init segment followed by n fragments with a keyframe every gop fragments
+func testSource(n, gop int) []byte {
+	source := testInit()
+	for i := 0; i < n; i++ {
+		source = append(source, testFragment(uint32(i+1), uint64(i*TEST_SAMPLES*TEST_SAMPLE_DURATION), i%gop == 0)...)
+	}
+	return source
+}
+
+// a running representation of a channel with the given fragment store, without HTTP handlers nor pipe
+func newTestStream(t testing.TB, store string) *InputStream {
+	t.Helper()
+	channel := &Channel{Name: "test", Root: "/test"}
+	channel.live.Store(&Ingester{FragmentDuration: 1000, Horizon: 4, ControllerFrequency: 1, HeapSize: 10, Store: store, StoreDirectory: t.TempDir()})
+	stream, err := channel.newStream(&Representation{Id: "v"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stream.Stop)
+	return stream
+}
+
+// the moof alone, for the parser entry points taking a single box
+func testMoof(fragment []byte) []byte {
+	return fragment[:binary.BigEndian.Uint32(fragment)]
+}
+
+// the init segment and the first media segment (styp, moof, mdat) of a real packager, see testdata/README
+func testEncoderOutput(t testing.TB, track string) (init, segment []byte) {
+	t.Helper()
+	init, err := os.ReadFile("testdata/" + track + "_init.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment, err = os.ReadFile("testdata/" + track + "_1.m4s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return init, segment
+}
+
+// the box of the given type at the top level of data, header included
+func topLevelBox(t testing.TB, data []byte, atomType string) []byte {
+	t.Helper()
+	p := NewMP4Parser(nil, nil)
+	for offset := 0; offset < len(data); {
+		atom, next, err := p.readAtom(data, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if atom.Type == atomType {
+			return data[offset:next]
+		}
+		offset = next
+	}
+	t.Fatalf("no %s box", atomType)
+	return nil
+}
+
+func addBoxSeeds(f *testing.F, add func(data []byte)) {
+	for _, track := range []string{"avc", "aac"} {
+		init, segment := testEncoderOutput(f, track)
+		add(init)
+		add(topLevelBox(f, init, "moov"))
+		add(topLevelBox(f, segment, "moof"))
+		add(segment)
+		add(append(init, segment...))
+	}
+	fragment := testFragment(1, 90000, true)
+	add(testInit())
+	add(testMoof(fragment))
+	add(fragment)
+	add(makeLargeBox("moof", makeBox("mfhd", u32(0), u32(7)), makeBox("traf", makeFullBox("tfdt", 1, 0, u64(1<<40)))))
+	add(append(makeBox("free"), append(u32(0), []byte("mdat\x00\x01\x02")...)...)) // size 0 runs to the end
+	add(append(u32(1), []byte("moof")...))                                         // largesize missing
+	add(append(u32(1), append([]byte("moof"), u64(8)...)...))                      // largesize smaller than its header
+	add(append(u32(7), []byte("moov")...))                                         // size smaller than the header
+}
+
+func FuzzReadAtom(f *testing.F) {
+	addBoxSeeds(f, func(data []byte) { f.Add(data, 0) })
+	f.Add(testInit(), 24)
+	f.Add(testInit(), -1)
+	f.Add(testInit(), math.MaxInt-4) // offset+8 wraps around
+	f.Fuzz(func(t *testing.T, data []byte, offset int) {
+		p := NewMP4Parser(nil, nil)
+		atom, next, err := p.readAtom(data, offset)
+		if err != nil {
+			if !errors.Is(err, ErrBoxTruncated) && !errors.Is(err, ErrBoxInvalidSize) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			return
+		}
+		if next <= offset || next > len(data) || uint64(next-offset) != atom.Size {
+			t.Fatalf("box at %d of size %d ends at %d out of %d bytes", offset, atom.Size, next, len(data))
+		}
+		if header := atom.Size - uint64(len(atom.Data)); header != 8 && header != 16 {
+			t.Fatalf("header of %d bytes", header)
+		}
+	})
+}
+
+func FuzzFindAtom(f *testing.F) {
+	addBoxSeeds(f, func(data []byte) { f.Add(data, "moof") })
+	f.Add(testInit(), "moov")
+	f.Add(testInit(), "mdat")
+	f.Fuzz(func(t *testing.T, data []byte, atomType string) {
+		p := NewMP4Parser(nil, nil)
+		atom, err := p.findAtom(data, atomType)
+		if err == nil && atom.Type != atomType {
+			t.Fatalf("asked for %q, found %q", atomType, atom.Type)
+		}
+		atoms, _ := p.findAllAtoms(data, atomType)
+		for _, a := range atoms {
+			if a.Type != atomType {
+				t.Fatalf("asked for %q, found %q", atomType, a.Type)
+			}
+		}
+		p.findPath(data, "moov", "trak", "mdia", "minf", "stbl", "stsd")
+		p.findPath(data, "moof", "traf", atomType)
+	})
+}
+
+func FuzzGetDecodeTime(f *testing.F) {
+	addBoxSeeds(f, func(data []byte) { f.Add(data) })
+	f.Fuzz(func(t *testing.T, moof []byte) {
+		p := NewMP4Parser(testMoov(), moof)
+		dt, err := p.GetDecodeTime()
+		if err != nil && dt != 0 {
+			t.Fatalf("decode time %d along with %v", dt, err)
+		}
+		p.GetDuration()
+		p.GetSequenceNumber()
+		p.GetSampleCount()
+		p.GetTrackRuns()
+		p.IsIFrame()
+	})
+}
+
+func TestGetDecodeTime(t *testing.T) {
+	for _, moof := range [][]byte{
+		testMoof(testFragment(3, 1<<40, true)),
+		makeLargeBox("moof", makeBox("traf", makeFullBox("tfdt", 1, 0, u64(1<<40)))),
+		makeBox("moof", makeBox("traf", makeFullBox("tfdt", 1, 0, u64(1<<40))), append(u32(0), []byte("free")...)),
+	} {
+		dt, err := NewMP4Parser(nil, moof).GetDecodeTime()
+		if err != nil || dt != 1<<40 {
+			t.Errorf("decode time %d, %v", dt, err)
+		}
+	}
+}
+
+func TestGetTrackRunsSampleCount(t *testing.T) {
+	// every sample from the tfhd defaults, nothing in the trun bounds the count
+	moof := makeBox("moof", makeBox("traf", makeFullBox("tfhd", 0, 0x38, u32(1), u32(3000), u32(100), u32(0)), makeFullBox("trun", 0, 0, u32(math.MaxUint32))))
+	if _, err := NewMP4Parser(nil, moof).GetTrackRuns(); !errors.Is(err, ErrBoxInvalidSize) {
+		t.Errorf("trun of %d samples: %v", uint32(math.MaxUint32), err)
+	}
+	moof = makeBox("moof", makeBox("traf", makeFullBox("tfhd", 0, 0x38, u32(1), u32(3000), u32(100), u32(0)), makeFullBox("trun", 0, 0, u32(30))))
+	if runs, err := NewMP4Parser(nil, moof).GetTrackRuns(); err != nil || len(runs) != 1 || len(runs[0].Samples) != 30 || runs[0].Samples[29].Size != 100 {
+		t.Errorf("trun of 30 default samples: %v %v", runs, err)
+	}
+}
+
+// the ingest fuzzers build a stream for each input, minimizing takes long at the default -fuzzminimizetime:
+// go test -fuzz FuzzParse -fuzzminimizetime 200x
+func FuzzParse(f *testing.F) {
+	addBoxSeeds(f, func(data []byte) { f.Add(data) })
+	f.Add(testSource(4, 2))
+	f.Add(append(testSource(2, 1), append([]byte("garbage"), testSource(2, 1)...)...))
+	f.Fuzz(func(t *testing.T, source []byte) {
+		stream := newTestStream(t, STORE_HEAP)
+		if err := stream.Parse(bytes.NewReader(source)); err == nil {
+			t.Fatal("parsing ended without the source failing")
+		}
+	})
+}
+
+func TestParseEncoderOutput(t *testing.T) {
+	for track, expected := range map[string]struct {
+		codecs    string
+		timescale uint32
+		duration  uint64
+	}{
+		"avc": {"avc1.64001e", 90000, 180000}, // 60 frames at 30 fps
+		"aac": {"mp4a.40.2", 48000, 96256},    // 94 frames of 1024 samples
+	} {
+		init, segment := testEncoderOutput(t, track)
+		stream := newTestStream(t, STORE_HEAP)
+		if err := stream.Parse(bytes.NewReader(append(init, segment...))); !errors.Is(err, io.EOF) {
+			t.Errorf("%s: parsing ended with %v", track, err)
+		}
+		fragment := stream.GetCompleteFragment(1)
+		if stream.repr.Codecs != expected.codecs || stream.timescale != expected.timescale || fragment == nil {
+			t.Fatalf("%s: codecs %q, timescale %d, fragment %v", track, stream.repr.Codecs, stream.timescale, fragment)
+		}
+		if !fragment.Keyframe || fragment.Pts != 0 || fragment.Duration != expected.duration || fragment.ByteLength != uint32(len(segment)-len(topLevelBox(t, segment, "styp"))) {
+			t.Errorf("%s: fragment %+v", track, fragment)
+		}
+	}
+}
+
+func TestGetCodecString(t *testing.T) {
+	hvcC := func(profile byte, compatibility uint32, constraint, level byte) []byte {
+		return makeBox("hvcC", []byte{1, profile}, u32(compatibility), []byte{constraint, 0, 0, 0, 0, 0, level}, make([]byte, 10))
+	}
+	for expected, entry := range map[string][]byte{
+		"avc1.4d4028":      testVisualEntry("avc1", makeBox("avcC", []byte{1, 0x4d, 0x40, 0x28})),
+		"avc3.4d4028":      testVisualEntry("avc3", makeBox("avcC", []byte{1, 0x4d, 0x40, 0x28})),
+		"avc1":             testVisualEntry("avc1"), // no avcC
+		"hvc1.1.6.L120.90": testVisualEntry("hvc1", hvcC(0x01, 0x60000000, 0x90, 120)),
+		"hev1.2.4.H153.b0": testVisualEntry("hev1", hvcC(0x22, 0x20000000, 0xb0, 153)),
+		"hvc1.1.6.L93":     testVisualEntry("hvc1", hvcC(0x01, 0x60000000, 0, 93)), // zero constraint bytes omitted
+		"av01.0.08M.08":    testVisualEntry("av01", makeBox("av1C", []byte{0x81, 0x08, 0x00, 0})),
+		"av01.0.13H.10":    testVisualEntry("av01", makeBox("av1C", []byte{0x81, 0x0d, 0xc0, 0})),
+		"av01.2.09M.12":    testVisualEntry("av01", makeBox("av1C", []byte{0x81, 0x49, 0x60, 0})),
+	} {
+		codecs, err := NewMP4Parser(testTrackMoov("vide", TEST_TIMESCALE, entry), nil).GetCodecString()
+		if err != nil || codecs != expected {
+			t.Errorf("%s: %q, %v", expected, codecs, err)
+		}
+	}
+	for expected, entry := range map[string][]byte{
+		"mp4a.40.2":  testAudioEntry("mp4a", 2, 48000, testEsds(0x40, 128000, 0x11, 0x90)),
+		"mp4a.40.5":  testAudioEntry("mp4a", 2, 48000, testEsds(0x40, 64000, 0x2b, 0x11, 0x88)), // HE-AAC
+		"mp4a.40.42": testAudioEntry("mp4a", 2, 48000, testEsds(0x40, 64000, 0xf9, 0x40)),       // escaped object type (USAC)
+		"mp4a.40":    testAudioEntry("mp4a", 2, 48000, testEsds(0x40, 64000)),                   // no AudioSpecificConfig
+		"mp4a.6b":    testAudioEntry("mp4a", 2, 44100, testEsds(0x6b, 192000)),                  // MP3
+		"mp4a":       testAudioEntry("mp4a", 2, 48000),                                          // no esds
+		"opus":       testAudioEntry("Opus", 2, 48000),
+		"ac-3":       testAudioEntry("ac-3", 6, 48000),
+	} {
+		codecs, err := NewMP4Parser(testTrackMoov("soun", 48000, entry), nil).GetCodecString()
+		if err != nil || codecs != expected {
+			t.Errorf("%s: %q, %v", expected, codecs, err)
+		}
+	}
+}
+
+func TestParseVideoInfo(t *testing.T) {
+	// BT.2020 primaries and matrix, PQ transfer, limited range
+	colr := makeBox("colr", []byte("nclx"), u16(9), u16(16), u16(9), []byte{0})
+	entry := testVisualEntry("hvc1", makeBox("hvcC", []byte{1, 0x02}, u32(0x20000000), make([]byte, 17)), makeBox("pasp", u32(4), u32(3)), colr)
+	source := append(makeBox("ftyp", []byte("iso5"), u32(0)), testTrackMoov("vide", TEST_TIMESCALE, entry)...)
+	source = append(source, testFragment(1, 0, true)...)
+	stream := newTestStream(t, STORE_HEAP)
+	stream.Parse(bytes.NewReader(source))
+	repr := stream.repr
+	if repr.Type != VIDEO || repr.Width != 1280 || repr.Height != 720 || repr.Sar != "4:3" || repr.FrameRate != 30 {
+		t.Errorf("video representation %+v", *repr)
+	}
+	if repr.Color == nil || *repr.Color != (ColorInfo{Primaries: 9, Transfer: 16, Matrix: 9}) {
+		t.Errorf("colour info %+v", repr.Color)
+	}
+	for rate, expected := range map[float32]string{30: "30", 25: "25", 29.97: "30000/1001", 59.94: "60000/1001", 12.5: "12500/1000", 0: ""} {
+		if s := FrameRateString(rate); s != expected {
+			t.Errorf("frame rate %v: %q, expected %q", rate, s, expected)
+		}
+	}
+}
+
+func FuzzParseInit(f *testing.F) {
+	addBoxSeeds(f, func(data []byte) { f.Add(data) })
+	f.Add(testMoov())
+	f.Fuzz(func(t *testing.T, moov []byte) {
+		stream := newTestStream(t, STORE_HEAP)
+		if err := stream.parseInit(moov); err == nil && (stream.timescale == 0 || stream.codec == "") {
+			t.Fatalf("init accepted without timescale (%d) or codec (%q)", stream.timescale, stream.codec)
+		}
+	})
+}
+
+func FuzzParseFragment(f *testing.F) {
+	addBoxSeeds(f, func(data []byte) { f.Add(data) })
+	f.Fuzz(func(t *testing.T, moof []byte) {
+		stream := newTestStream(t, STORE_HEAP)
+		if err := stream.parseInit(testMoov()); err != nil {
+			t.Fatal(err)
+		}
+		frag, err := stream.parseFragment(moof)
+		if err == nil && (frag.Timescale != TEST_TIMESCALE || frag.ByteLength != uint32(len(moof))) {
+			t.Fatalf("fragment %+v out of a %d bytes moof", frag, len(moof))
+		}
+	})
+}
@@ -1,5 +1,126 @@
 package main
 
+// GetKeyframeSize returns the size of the key picture in an mdat atom, choosing the parser from the
+// sample entry fourcc of the video track. Returns 0 if no key picture is found
+func GetKeyframeSize(codec string, mdat []byte) uint32 {
+	switch codec {
+	case "hvc1", "hev1":
+		return getHEVCKeyframeSize(mdatPayload(mdat))
+	case "av01":
+		return getAV1KeyframeSize(mdatPayload(mdat))
+	default: // avc1, avc3
+		return GetIFrameSize(mdat)
+	}
+}
+
+// skips the mdat header, either the standard 8 bytes or the 16 bytes of the extended size
+func mdatPayload(mdat []byte) []byte {
+	if len(mdat) < 8 {
+		return nil
+	}
+	if len(mdat) >= 16 && mdat[0] == 0 && mdat[1] == 0 && mdat[2] == 0 && mdat[3] == 1 {
+		return mdat[16:]
+	}
+	return mdat[8:]
+}
+
+// getHEVCKeyframeSize sums the IRAP slices (IDR_W_RADL, IDR_N_LP, CRA) of the first key picture
+// NAL units are length prefixed (4 bytes) as in hvcC, the NAL type is in bits 1-6 of the 2 bytes header
+func getHEVCKeyframeSize(data []byte) uint32 {
+	size := uint32(0)
+	pos := uint32(0)
+	for pos+4 < uint32(len(data)) {
+		nalSize := uint32(data[pos])<<24 | uint32(data[pos+1])<<16 | uint32(data[pos+2])<<8 | uint32(data[pos+3])
+		// compared with the bytes left, pos+4+nalSize would wrap around and move pos backwards
+		if nalSize == 0 || nalSize > uint32(len(data))-pos-4 {
+			break
+		}
+
+		nalType := (data[pos+4] >> 1) & 0x3F
+		switch {
+		case nalType == 19 || nalType == 20 || nalType == 21: // IDR_W_RADL, IDR_N_LP, CRA_NUT
+			size += nalSize
+		case nalType < 32 && size > 0: // a non IRAP slice ends the key picture
+			return size
+		}
+
+		pos += 4 + nalSize
+	}
+	return size
+}
+
+// getAV1KeyframeSize sums the sequence header and the OBUs of the first key frame (frame or frame header + tile groups)
+// OBUs in MP4 samples use the low overhead format, each carrying its own leb128 size
+func getAV1KeyframeSize(data []byte) uint32 {
+	const (
+		OBU_SEQUENCE_HEADER = 1
+		OBU_FRAME_HEADER    = 3
+		OBU_TILE_GROUP      = 4
+		OBU_FRAME           = 6
+	)
+
+	size := uint32(0)
+	sequenceHeader := uint32(0)
+	inKeyframe := false
+	pos := 0
+	for pos < len(data) {
+		header := data[pos]
+		obuType := (header >> 3) & 0x0F
+		headerSize := 1
+		if header&0x04 != 0 { // obu_extension_flag
+			headerSize++
+		}
+		if header&0x02 == 0 { // obu_has_size_field, without it the OBU length is unknown
+			break
+		}
+		payloadSize, lebSize := readLeb128(data[min(pos+headerSize, len(data)):])
+		if lebSize == 0 {
+			break
+		}
+		start := pos + headerSize + lebSize
+		end := start + int(payloadSize)
+		if end > len(data) {
+			break
+		}
+		obuSize := uint32(end - pos)
+
+		switch obuType {
+		case OBU_SEQUENCE_HEADER:
+			sequenceHeader = obuSize
+		case OBU_FRAME, OBU_FRAME_HEADER:
+			if inKeyframe {
+				return size + sequenceHeader // the next frame begins
+			}
+			// show_existing_frame(1) frame_type(2), KEY_FRAME is 0
+			if start < end && data[start]&0x80 == 0 && (data[start]>>5)&0x03 == 0 {
+				inKeyframe = true
+				size += obuSize
+			}
+		case OBU_TILE_GROUP:
+			if inKeyframe {
+				size += obuSize
+			}
+		}
+		pos = end
+	}
+	if !inKeyframe {
+		return 0
+	}
+	return size + sequenceHeader
+}
+
+// reads an unsigned LEB128 value, returns the number of bytes used (0 if invalid)
+func readLeb128(data []byte) (uint64, int) {
+	value := uint64(0)
+	for i := 0; i < 8 && i < len(data); i++ {
+		value |= uint64(data[i]&0x7F) << (7 * i)
+		if data[i]&0x80 == 0 {
+			return value, i + 1
+		}
+	}
+	return 0, 0
+}
+
 // GetIFrameSize returns the size of the I-frame in an H.264 stream (from an MP4 mdat atom)
 // Returns 0 if no I-frame is found
 func GetIFrameSize(mdat []byte) uint32 {
@@ -32,7 +153,7 @@ func GetIFrameSize(mdat []byte) uint32 {
 		// Get NAL unit size (4 bytes)
 		nalSize := uint32(data[pos])<<24 | uint32(data[pos+1])<<16 | uint32(data[pos+2])<<8 | uint32(data[pos+3])
 
-		if nalSize <= 0 || pos+4+nalSize > uint32(len(data)) {
+		if nalSize <= 0 || nalSize > uint32(len(data))-pos-4 {
 			// Invalid NAL size or would go beyond data
 			// log.Printf("Invalid NAL size %d at position %d", nalSize, pos)
 			break
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// a length prefixed NAL unit (AVC and HEVC in MP4) made of its header and size-len(header) bytes
+func nal(size uint32, header ...byte) []byte {
+	return append(u32(size), append(header, bytes.Repeat([]byte{0xAA}, int(size)-len(header))...)...)
+}
+
+// a low overhead AV1 OBU with its size field
+func obu(obuType byte, payload ...byte) []byte {
+	return append([]byte{obuType<<3 | 0x02, byte(len(payload))}, payload...)
+}
+
+func TestGetKeyframeSize(t *testing.T) {
+	for _, test := range []struct {
+		name, codec string
+		mdat        []byte
+		size        uint32
+	}{
+		{"avc idr", "avc1", makeBox("mdat", nal(6, 0x67), nal(20, 0x65), nal(9, 0x41)), 20},
+		{"avc without idr", "avc1", makeBox("mdat", nal(9, 0x41), nal(9, 0x41)), 0},
+		{"avc start codes", "avc3", makeBox("mdat", []byte{0, 0, 0, 1, 0x67, 1, 2, 0, 0, 1, 0x65, 1, 2, 3, 4, 0, 0, 1, 0x41, 1}), 5},
+		// VPS, two IDR_W_RADL slices, then a TRAIL_R slice of the next picture
+		{"hevc idr", "hvc1", makeBox("mdat", nal(4, 32<<1, 1), nal(12, 19<<1, 1), nal(6, 19<<1, 1), nal(8, 1<<1, 1)), 18},
+		{"hevc cra", "hev1", makeBox("mdat", nal(10, 21<<1, 1)), 10},
+		{"hevc without irap", "hvc1", makeBox("mdat", nal(8, 1<<1, 1)), 0},
+		// sequence header, key frame, inter frame
+		{"av1 key frame", "av01", makeBox("mdat", obu(1, 1, 2, 3), obu(6, 0x10, 1, 2, 3), obu(6, 0x20, 1)), 11},
+		{"av1 frame header and tile group", "av01", makeBox("mdat", obu(3, 0x10), obu(4, 1, 2), obu(3, 0x20)), 7},
+		{"av1 inter frame", "av01", makeBox("mdat", obu(6, 0x20, 1)), 0},
+		// NAL lengths wrapping pos+4+size around uint32
+		{"hevc wrapping size", "hvc1", append(make([]byte, 8), 0xFF, 0xFF, 0xFF, 0xFC, 0, 0, 0, 0), 0},
+		{"hevc wrapping second size", "hvc1", makeBox("mdat", nal(4, 1<<1, 1), []byte{0xFF, 0xFF, 0xFF, 0xF8, 0, 0, 0, 0}), 0},
+		{"avc wrapping size", "avc1", append(make([]byte, 8), 0xFF, 0xFF, 0xFF, 0xFC, 0, 0, 0, 0), 0},
+		{"avc wrapping second size", "avc1", makeBox("mdat", nal(4, 0x41), []byte{0xFF, 0xFF, 0xFF, 0xF8, 0, 0, 0, 0}), 0},
+		{"av1 oversized obu", "av01", makeBox("mdat", []byte{6<<3 | 0x02, 0xFF, 0xFF, 0xFF, 0xFF, 0x0F, 0x10}), 0},
+		{"truncated", "hvc1", []byte{0, 0, 0}, 0},
+	} {
+		if size := GetKeyframeSize(test.codec, test.mdat); size != test.size {
+			t.Errorf("%s: %d bytes, want %d", test.name, size, test.size)
+		}
+	}
+}
+
+func FuzzGetKeyframeSize(f *testing.F) {
+	_, segment := testEncoderOutput(f, "avc")
+	mdat := topLevelBox(f, segment, "mdat")
+	for _, codec := range []string{"avc1", "hvc1", "av01"} {
+		f.Add(codec, makeBox("mdat", nal(6, 0x67), nal(20, 0x65)))
+		f.Add(codec, makeBox("mdat", nal(4, 32<<1, 1), nal(12, 19<<1, 1), nal(8, 1<<1, 1)))
+		f.Add(codec, makeBox("mdat", obu(1, 1, 2, 3), obu(6, 0x10, 1, 2, 3), obu(6, 0x20, 1)))
+		f.Add(codec, append(make([]byte, 8), 0xFF, 0xFF, 0xFF, 0xFC, 0, 0, 0, 0))
+		f.Add(codec, testFragment(1, 0, true)[len(testMoof(testFragment(1, 0, true))):])
+		f.Add(codec, mdat)
+	}
+	f.Fuzz(func(t *testing.T, codec string, mdat []byte) {
+		// must return, within the payload
+		if size := GetKeyframeSize(codec, mdat); int(size) > len(mdat) {
+			t.Errorf("%d bytes key frame in a %d bytes mdat", size, len(mdat))
+		}
+	})
+}
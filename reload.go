@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// the memory window (HeapSize fragments) must list at least 3 segments of 2 seconds, the shortest HLS playlist
+const MIN_MEMORY_WINDOW = 6 * time.Second
+
+var reloadMu sync.Mutex // one reload at a time, SIGHUP and admin API alike
+
+// loadConfig reads and validates the configuration file
+func loadConfig(path string) (*Config, error) {
+	loaded := &Config{}
+	if _, err := toml.DecodeFile(path, loaded); err != nil {
+		return nil, err
+	}
+	if err := loaded.Validate(); err != nil {
+		return nil, err
+	}
+	return loaded, nil
+}
+
+// Validate reports every inconsistency of the configuration at once
+func (config *Config) Validate() error {
+	var errs []error
+	if err := config.Log.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("[Log]: %w", err))
+	}
+
+	if err := config.Auth.loadKeys(); err != nil {
+		errs = append(errs, fmt.Errorf("[Auth] JWKS: %w", err))
+	}
+	if slices.Contains(config.Auth.Origins, "") {
+		errs = append(errs, errors.New("[Auth] Origins cannot contain an empty origin"))
+	}
+
+	if _, _, err := net.SplitHostPort(config.Server.Address); err != nil {
+		errs = append(errs, fmt.Errorf("[Server] Address %q: %w", config.Server.Address, err))
+	}
+	if config.Server.RedirectAddress != "" {
+		if _, _, err := net.SplitHostPort(config.Server.RedirectAddress); err != nil {
+			errs = append(errs, fmt.Errorf("[Server] RedirectAddress %q: %w", config.Server.RedirectAddress, err))
+		}
+	}
+	if (config.Server.TLSCert == "") != (config.Server.TLSKey == "") {
+		errs = append(errs, errors.New("[Server] TLSCert and TLSKey must be set together"))
+	}
+	if root := config.Server.Root; root != "" && (!strings.HasPrefix(root, "/") || strings.HasSuffix(root, "/")) {
+		errs = append(errs, fmt.Errorf("[Server] Root %q must start with / and not end with /", root))
+	}
+
+	list, err := config.channelList()
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	pipes := map[string]string{} // pipe -> representation reading it
+	for _, channel := range list {
+		section := "[Ingester]"
+		if channel.Name != "" {
+			section = fmt.Sprintf("[Channels.%s]", channel.Name)
+		}
+		ingester := channel.Ingester
+		if ingester.FragmentDuration == 0 {
+			errs = append(errs, fmt.Errorf("%s FragmentDuration must be greater than 0", section))
+		}
+		if ingester.Horizon <= 0 {
+			errs = append(errs, fmt.Errorf("%s Horizon must be greater than 0", section))
+		}
+		if ingester.ControllerFrequency <= 0 || ingester.ControllerFrequency > ingester.Horizon {
+			errs = append(errs, fmt.Errorf("%s ControllerFrequency (%d) must be between 1 and Horizon (%d)", section, ingester.ControllerFrequency, ingester.Horizon))
+		}
+		if ingester.HeapSize <= uint32(max(ingester.Horizon, 0)) {
+			errs = append(errs, fmt.Errorf("%s HeapSize (%d) must be greater than Horizon (%d)", section, ingester.HeapSize, ingester.Horizon))
+		}
+		if window := time.Duration(ingester.HeapSize) * time.Duration(ingester.FragmentDuration) * time.Millisecond; window < MIN_MEMORY_WINDOW {
+			errs = append(errs, fmt.Errorf("%s HeapSize (%d) of %d ms fragments keeps %s in memory, at least %s are needed", section, ingester.HeapSize, ingester.FragmentDuration, window, MIN_MEMORY_WINDOW))
+		}
+		switch ingester.Store {
+		case "", STORE_MEMFD, STORE_HEAP, STORE_FILE:
+		default:
+			errs = append(errs, fmt.Errorf("%s unknown Store %q", section, ingester.Store))
+		}
+		for id, repr := range channel.Representations {
+			if repr.Pipe == "" {
+				continue
+			}
+			name := strings.TrimPrefix(channel.Name+"/"+id, "/")
+			if other, ok := pipes[repr.Pipe]; ok {
+				errs = append(errs, fmt.Errorf("pipe %s is read by both %s and %s", repr.Pipe, other, name))
+			}
+			pipes[repr.Pipe] = name
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Reload reads the configuration file again and applies what can change without dropping connections:
+// ingester tuning, logging levels, server timeouts, new representations and pipe or log changes of the existing ones
+// the returned notes list the changes that need a restart, the current configuration is kept on error
+func Reload() ([]string, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	next, err := loadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	current := config.Load()
+	notes := []string{}
+	keep := func(name string, changed bool) {
+		if changed {
+			notes = append(notes, name+" changed, restart to apply it")
+		}
+	}
+
+	// listeners and paths are bound at startup
+	keep("[Server] Address", next.Server.Address != current.Server.Address)
+	keep("[Server] Root", next.Server.Root != current.Server.Root)
+	keep("[Server] TLSCert", next.Server.TLSCert != current.Server.TLSCert)
+	keep("[Server] TLSKey", next.Server.TLSKey != current.Server.TLSKey)
+	keep("[Server] RedirectAddress", next.Server.RedirectAddress != current.Server.RedirectAddress)
+	keep("[Archive]", next.Archive != current.Archive)
+	keep("[Log] Format", !strings.EqualFold(next.Log.Format, current.Log.Format))
+	next.Server.Address, next.Server.Root = current.Server.Address, current.Server.Root
+	next.Server.TLSCert, next.Server.TLSKey = current.Server.TLSCert, current.Server.TLSKey
+	next.Server.RedirectAddress = current.Server.RedirectAddress
+	next.Archive = current.Archive
+	next.Log.Format = current.Log.Format
+
+	list, _ := next.channelList() // validated by loadConfig
+	nextChannels := map[string]*Channel{}
+	for _, channel := range list {
+		nextChannels[channel.Name] = channel
+	}
+	for name := range nextChannels {
+		if findChannel(name) == nil {
+			notes = append(notes, fmt.Sprintf("channel %q added, restart to serve it", name))
+		}
+	}
+
+	config.Store(next)
+	next.Log.Apply()
+
+	for _, channel := range channels {
+		update, ok := nextChannels[channel.Name]
+		if !ok {
+			notes = append(notes, fmt.Sprintf("channel %q removed, still served until restart", channel.Name))
+			continue
+		}
+		notes = append(notes, channel.reload(update, next.Log)...)
+	}
+	return notes, nil
+}
+
+// applies the ingester tuning and the representations of the reloaded configuration of the channel
+func (channel *Channel) reload(update *Channel, log Log) []string {
+	notes := []string{}
+	prefix := ""
+	if channel.Name != "" {
+		prefix = fmt.Sprintf("channel %q: ", channel.Name)
+	}
+
+	// the fragment grid, the forecast window and the stores of the running streams stay as they are
+	current := channel.ingester()
+	ingester := update.Ingester
+	if ingester.FragmentDuration != current.FragmentDuration || ingester.Horizon != current.Horizon ||
+		ingester.Store != current.Store || ingester.StoreDirectory != current.StoreDirectory {
+		notes = append(notes, prefix+"FragmentDuration, Horizon, Store and StoreDirectory changes need a restart")
+	}
+	ingester.FragmentDuration, ingester.Horizon = current.FragmentDuration, current.Horizon
+	ingester.Store, ingester.StoreDirectory = current.Store, current.StoreDirectory
+	ingester.ControllerFrequency = min(ingester.ControllerFrequency, ingester.Horizon)
+	channel.live.Store(&ingester)
+
+	for _, stream := range channel.Streams() {
+		stream.logLevel.Set(log.StreamLevel(stream.repr))
+		if _, ok := update.Representations[stream.repr.Id]; !ok {
+			notes = append(notes, prefix+"representation "+stream.repr.Id+" is not configured anymore, remove it through the admin API")
+		}
+	}
+	for id, repr := range update.Representations {
+		stream := channel.stream(id)
+		if stream != nil && stream.repr.Pipe == repr.Pipe && stream.repr.Log == repr.Log && stream.repr.LogLevel == repr.LogLevel {
+			continue
+		}
+		if _, created, err := channel.AddRepresentation(id, *repr); err != nil {
+			notes = append(notes, fmt.Sprintf("%srepresentation %s: %s", prefix, id, err))
+		} else if created {
+			mainLog.Info("representation added", "channel", channel.Name, "representation", id, "pipe", repr.Pipe)
+		}
+	}
+	return notes
+}
+
+// WatchReload reloads the configuration on SIGHUP
+func WatchReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		logReload(Reload())
+	}
+}
+
+func logReload(notes []string, err error) {
+	if err != nil {
+		mainLog.Error("reloading config, keeping the current one", "file", configFile, "error", err)
+		return
+	}
+	mainLog.Info("config reloaded", "file", configFile)
+	for _, note := range notes {
+		mainLog.Warn("config reload", "note", note)
+	}
+}
+
+// ReloadHandler reloads the configuration on POST {Root}/admin/reload, answering the errors or the changes not applied
+func ReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	notes, err := Reload()
+	logReload(notes, err)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintln(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	for _, note := range notes {
+		fmt.Fprintln(w, note)
+	}
+}
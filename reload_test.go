@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestValidateShortFragments(t *testing.T) {
+	loaded := &Config{}
+	if _, err := toml.Decode(`
+[Server]
+Address = ":8080"
+
+[Ingester]
+FragmentDuration = 500
+Horizon = 4
+ControllerFrequency = 1
+HeapSize = 120
+`, loaded); err != nil {
+		t.Fatal(err)
+	}
+	// sub-second fragments without an archive keep every listed segment in memory
+	if err := loaded.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateMemoryWindow(t *testing.T) {
+	loaded := &Config{}
+	if _, err := toml.Decode(`
+[Server]
+Address = ":8080"
+
+[Ingester]
+FragmentDuration = 200
+Horizon = 4
+ControllerFrequency = 1
+HeapSize = 20
+`, loaded); err != nil {
+		t.Fatal(err)
+	}
+	// 20 fragments of 200 ms are 4 seconds
+	if err := loaded.Validate(); err == nil || !strings.Contains(err.Error(), "HeapSize (20)") {
+		t.Errorf("4 seconds window accepted: %v", err)
+	}
+	loaded.Ingester.HeapSize = 30
+	if err := loaded.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReloadLowersControllerFrequency(t *testing.T) {
+	stream := newTestStream(t, STORE_HEAP)
+	channel := stream.channel
+	channel.streams = append(channel.streams, stream)
+	channel.events = make(chan Event, 16)
+	ingester := *channel.ingester()
+	ingester.ControllerFrequency = 3
+	channel.live.Store(&ingester)
+	// a live representation, its window updated one fragment at a time
+	stream.moov = testInit()
+	stream.metrics.lastIngest.Store(time.Now().UnixNano())
+	go channel.publishForecast(stream)
+	add := func(seq uint32) {
+		stream.fragmentsWindow.Add(&Fragment{Sequence: seq, Pts: uint64(seq) * TEST_TIMESCALE, Timescale: TEST_TIMESCALE})
+		time.Sleep(50 * time.Millisecond)
+	}
+	add(1)
+	add(2)
+	if len(channel.events) != 0 {
+		t.Fatalf("%d forecasts sent before 3 updates", len(channel.events))
+	}
+
+	// down to 1 while 2 updates are counted
+	update := &Channel{Ingester: ingester, Representations: map[string]*Representation{"v": {}}}
+	update.Ingester.ControllerFrequency = 1
+	if notes := channel.reload(update, Log{}); len(notes) != 0 {
+		t.Errorf("reload notes %v", notes)
+	}
+	add(3)
+	select {
+	case event := <-channel.events:
+		if !bytes.Contains(event.Data, []byte(`"seq":3`)) {
+			t.Errorf("event %s", event.Data)
+		}
+	case <-time.After(time.Second):
+		t.Error("no forecast after lowering ControllerFrequency")
+	}
+}
@@ -1,20 +1,34 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
-
-	"github.com/justincormack/go-memfd"
-	"golang.org/x/sys/unix"
 )
 
 type Server struct {
-	Address string
-	Root string
+	Address         string
+	Root            string
+	BlockingTimeout uint32 // how long a request for a segment not produced yet is held [milliseconds], 0 answers 404
+	ChunkedSegments bool   // held segments are streamed fragment by fragment instead of waiting for completion
+	TLSCert         string // PEM certificate (chain), serves HTTPS and HTTP/2 when set along with TLSKey
+	TLSKey          string // PEM private key
+	RedirectAddress string // plain HTTP listener redirecting to HTTPS, e.g. ":80", empty disables it
+	StallThreshold  uint32 // a representation without new fragments for this long is not ready [milliseconds], 0 is 5 fragment durations
+	AdminToken      string // bearer token of the admin API on {Root}/admin/, empty disables it
+	IngestToken     string // bearer token of {Root}/ingest/, empty falls back to AdminToken, loopback clients only without either
 }
 
 type Manifest struct {
@@ -24,11 +38,18 @@ type Manifest struct {
 	Head            uint32                     `json:"head"`
 	Representations map[string]*Representation `json:"representations"`
 	Keyframes       map[string][]*Fragment     `json:"keyframes"`
+	Discontinuities map[string][]uint32        `json:"discontinuities"` // first fragment of each new timeline
 }
 
+// Serve routes {Root}/{channel}/{id}/... to the representation until it is removed
 func (stream *InputStream) Serve() {
-	http.HandleFunc(config.Server.Root+"/"+stream.repr.Id+"/", func(w http.ResponseWriter, r *http.Request) {
-		index, noIndexProvided := strconv.ParseUint(r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:], 10, 64)
+	stream.channel.handle(stream.repr.Id, func(w http.ResponseWriter, r *http.Request) {
+		rec := newResponseRecorder(w)
+		defer stream.metrics.served(rec)
+		w = rec
+
+		name := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		index, noIndexProvided := strconv.ParseUint(name, 10, 64)
 
 		// stream not yet initialized
 		if f := stream.GetLastFragment(); f == nil {
@@ -36,21 +57,92 @@ func (stream *InputStream) Serve() {
 			return
 		}
 
+		if name == "playlist.m3u8" {
+			stream.ServePlaylist(w, r)
+			return
+		}
+		if name == "clip" {
+			stream.ServeClip(w, r)
+			return
+		}
+		if noIndexProvided == nil && strings.HasSuffix(r.URL.Path, "/part/"+name) {
+			stream.ServePart(w, r, uint32(index))
+			return
+		}
+
+		// DASH SegmentTimeline addresses segments by generation and decode time (t/{generation}/$Time$) instead of the sequence number
+		if elements := strings.Split(r.URL.Path, "/"); noIndexProvided == nil && len(elements) > 3 && elements[len(elements)-3] == "t" {
+			var keyframe *Fragment
+			if generation, err := strconv.ParseUint(elements[len(elements)-2], 10, 32); err == nil {
+				keyframe = stream.GetKeyframeAt(uint32(generation), index)
+			}
+			if keyframe == nil {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprintf(w, "Segment at time %d not found", index)
+				return
+			}
+			index = uint64(keyframe.Sequence)
+		}
+
 		w.Header().Set("Content-Type", "application/octet-stream")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Timing-Allow-Origin", "*")
-		
+
 		if noIndexProvided != nil {
-			w.WriteHeader(http.StatusOK)
-			// io.Copy(w, bytes.NewReader(stream.moov))  // TODO: compare
-			if _, err := w.Write(stream.moov); err != nil {
-				fmt.Println("Error writing moov:", err)
+			// init-{generation}.mp4 is the one of the segments after a discontinuity, any other name the latest one
+			generation, moov := stream.generation, stream.moov
+			// the latest one changes when the encoder restarts, it is revalidated with its ETag
+			cacheControl := "no-cache"
+			if _, err := fmt.Sscanf(name, "init-%d.mp4", &generation); err == nil {
+				init := stream.init(generation)
+				if init == nil {
+					w.WriteHeader(http.StatusNotFound)
+					fmt.Fprintf(w, "Init segment %d not found", generation)
+					return
+				}
+				moov = init.moov
+				cacheControl = "max-age=180"
 			}
+			config.Load().Auth.cacheControl(w, cacheControl)
+			// ServeContent takes care of Range and If-Range on the init segment
+			w.Header().Set("ETag", fmt.Sprintf("\"init-%d-%d\"", generation, len(moov)))
+			http.ServeContent(w, r, "init.mp4", time.Time{}, bytes.NewReader(moov))
 			return
 		}
 
 		// if requested is not a keyframe, it's a bad request
 		fragment, keyedIndex := stream.GetPlayableFragment(uint32(index))
+		blockingTimeout := time.Duration(config.Load().Server.BlockingTimeout) * time.Millisecond
+
+		// a segment that starts in the near future is waited for, instead of being polled by the client
+		if last := stream.lastSeqNumber.Load(); fragment == nil && blockingTimeout > 0 && uint32(index) > last && uint32(index) <= last+uint32(stream.channel.ingester().Horizon) {
+			stream.WaitUntil(r.Context(), blockingTimeout, func() bool {
+				fragment, keyedIndex = stream.GetPlayableFragment(uint32(index))
+				return fragment != nil
+			})
+		}
+		if fragment == nil && stream.archive != nil {
+			// older than the memory window, it may still be in the time-shift window on disk
+			segment, files, err := stream.archive.Open(uint32(index))
+			if err == nil {
+				defer func() {
+					for _, file := range files {
+						file.Close()
+					}
+				}()
+				segmentHeaders(w, segment)
+				stream.cmsdHeaders(w, r, segment[0], segment)
+				start := time.Now()
+				stream.serveFile(w, r, files)
+				stream.delivered(r, rec.bytes, time.Since(start))
+				return
+			}
+			if errors.Is(err, ErrNotSegmentStart) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if !errors.Is(err, ErrNotArchived) {
+				stream.log.Error("opening archived segment", "seq", index, "error", err)
+			}
+		}
 		if fragment == nil {
 			// IMPR: you can redirect 302 to the correct resource or segment
 			w.WriteHeader(http.StatusNotFound)
@@ -62,7 +154,17 @@ func (stream *InputStream) Serve() {
 			return
 		}
 
-		segment, amount := stream.GetNextFragments(fragment)
+		segment, _ := stream.GetNextFragments(fragment)
+		if segment == nil && blockingTimeout > 0 {
+			if config.Load().Server.ChunkedSegments {
+				stream.streamSegment(w, r, fragment, blockingTimeout)
+				return
+			}
+			stream.WaitUntil(r.Context(), blockingTimeout, func() bool {
+				segment, _ = stream.GetNextFragments(fragment)
+				return segment != nil
+			})
+		}
 		if segment == nil {
 			w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
 			w.WriteHeader(http.StatusNotFound)
@@ -70,68 +172,292 @@ func (stream *InputStream) Serve() {
 			return
 		}
 
-		// debugging timestamp only
-		// w.Header().Set("ruddr-ingester", stream.timestamp.Add(time.Duration(fragment.Pts*float32(math.Pow10(9)))).Format(time.RFC3339Nano))
-		w.Header().Set("Ruddr-Pts", fmt.Sprintf("%.4f", fragment.Pts))    // keyframe presentation time
-		w.Header().Set("Ruddr-Segment-Length", fmt.Sprintf("%d", amount)) // length in fragments
-		// the next keyframed fragment can be calculated as = current + amount
-
-		w.Header().Set("Cache-Control", "public, max-age=180") //TODO: param
-		w.Header().Set("Access-Control-Expose-Headers", "ruddr-pts, ruddr-segment-length")
-
-		fds := make([]*memfd.Memfd, 0)
-		segmentSize := int64(0)
+		data := make([]FragmentData, 0, len(segment))
 		for _, frag := range segment {
-			fds = append(fds, frag.fd)
-			segmentSize += int64(frag.ByteLength)
+			data = append(data, frag.data)
 		}
-
-		serveFile(w, r, fds, segmentSize)
+		segmentHeaders(w, segment)
+		stream.cmsdHeaders(w, r, fragment, segment)
+		start := time.Now()
+		stream.serveFile(w, r, data)
+		stream.delivered(r, rec.bytes, time.Since(start))
 	})
 
 }
 
-func serveFile(w http.ResponseWriter, r *http.Request, fds []*memfd.Memfd, size int64) {
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
-	w.WriteHeader(http.StatusOK)
+// headers describing the segment made of the given fragments, the first one being the keyframe
+func segmentHeaders(w http.ResponseWriter, segment []*Fragment) {
+	// debugging timestamp only
+	// w.Header().Set("ruddr-ingester", stream.timestamp.Add(time.Duration(fragment.Seconds()*math.Pow10(9))).Format(time.RFC3339Nano))
+	w.Header().Set("Ruddr-Pts", fmt.Sprintf("%d", segment[0].Pts))             // keyframe presentation time, exact
+	w.Header().Set("Ruddr-Timescale", fmt.Sprintf("%d", segment[0].Timescale)) // units per second of Ruddr-Pts
+	w.Header().Set("Ruddr-Segment-Length", fmt.Sprintf("%d", len(segment)))    // length in fragments
+	// the next keyframed fragment can be calculated as = current + length
 
-	// Ensure headers are flushed before hijacking
-	if flusher, ok := w.(http.Flusher); ok {
-		flusher.Flush()
+	config.Load().Auth.cacheControl(w, "max-age=180") //TODO: param
+	w.Header().Set("Access-Control-Expose-Headers", "ruddr-pts, ruddr-timescale, ruddr-segment-length, cmsd-static, cmsd-dynamic")
+	w.Header().Set("ETag", fragmentsETag(segment))
+}
+
+// ProtectIngest lets through the uploads carrying the IngestToken (or else the AdminToken) as bearer token,
+// without any token configured only the encoders running on the same host are accepted
+func ProtectIngest(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		settings := config.Load().Server
+		token := cmp.Or(settings.IngestToken, settings.AdminToken)
+		if ip := net.ParseIP(clientIP(r)); token == "" && (ip == nil || !ip.IsLoopback()) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "Ingest from other hosts needs an IngestToken")
+			return
+		}
+		if token != "" && !authorized(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ruddr ingest"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
 	}
+}
 
-	hj, ok := w.(http.Hijacker)
-	if !ok {
-		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+// IngestHandler accepts a long-lived (chunked) fMP4 upload on {Root}/{channel}/ingest/{reprId} and feeds it to the parser
+// e.g. ffmpeg ... -f mp4 -movflags empty_moov+frag_keyframe -headers "Authorization: Bearer {IngestToken}" -method PUT http://host/{Root}/{channel}/ingest/{reprId}
+func (channel *Channel) IngestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "PUT, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	conn, _, err := hj.Hijack()
-	if err != nil {
-		http.Error(w, "Hijack failed", http.StatusInternalServerError)
+
+	reprId := strings.TrimPrefix(r.URL.Path, channel.Root+"/ingest/")
+	stream := channel.stream(reprId)
+	if stream == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Representation %s not found", reprId)
 		return
 	}
-	defer conn.Close()
 
-	// Get raw file descriptor of the TCP connection
-	tcpFile, err := conn.(*net.TCPConn).File()
+	// a removed representation ends the upload
+	defer context.AfterFunc(stream.ctx, func() {
+		http.NewResponseController(w).SetReadDeadline(time.Now())
+	})()
+
+	stream.log.Info("ingest connected", "remote", r.RemoteAddr)
+	if err := stream.Ingest(r.Body); errors.Is(err, ErrIngestBusy) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Representation %s is already being ingested", reprId)
+		return
+	} else if errors.Is(err, ErrStreamStopped) {
+		w.WriteHeader(http.StatusGone)
+		fmt.Fprintf(w, "Representation %s was removed", reprId)
+		return
+	} else {
+		stream.log.Info("ingest disconnected", "remote", r.RemoteAddr, "error", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writes the segment fragment by fragment as each mdat lands, using chunked transfer encoding
+// the response ends at the moof of the next keyframe, or when a fragment does not arrive in time
+func (stream *InputStream) streamSegment(w http.ResponseWriter, r *http.Request, keyframe *Fragment, timeout time.Duration) {
+	w.Header().Set("Ruddr-Pts", fmt.Sprintf("%d", keyframe.Pts))
+	w.Header().Set("Ruddr-Timescale", fmt.Sprintf("%d", keyframe.Timescale))
+	config.Load().Auth.cacheControl(w, "max-age=180")
+	w.Header().Set("Access-Control-Expose-Headers", "ruddr-pts, ruddr-timescale, cmsd-static, cmsd-dynamic")
+	stream.cmsdHeaders(w, r, keyframe, nil)
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	for seq := keyframe.Sequence; ; seq++ {
+		var frag *Fragment
+		arrived := stream.WaitUntil(r.Context(), timeout, func() bool {
+			var ok bool
+			if frag, ok = stream.fragments.Get(seq); !ok {
+				return false
+			}
+			// the next keyframe is known from its moof, no need to wait for its mdat
+			return frag.data != nil || (frag.Keyframe && seq != keyframe.Sequence)
+		})
+		if !arrived || (frag.Keyframe && seq != keyframe.Sequence) {
+			return
+		}
+		if err := writeSpans(w, []span{{frag.data, 0, frag.data.Size()}}); err != nil {
+			stream.log.Warn("streaming fragment", "seq", seq, "error", err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+var ErrRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// part of a fragment to be written
+type span struct {
+	data   FragmentData
+	offset int64
+	length int64
+}
+
+// byteRange reads a single Range (bytes=a-b, bytes=a-, bytes=-n) of a resource of the given size,
+// ok is false when the whole resource is to be sent: no Range, multiple ranges or a stale If-Range
+func byteRange(r *http.Request, size int64, etag string) (start, length int64, ok bool, err error) {
+	header := r.Header.Get("Range")
+	if header == "" || !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		return 0, size, false, nil
+	}
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && (ifRange != etag || strings.HasPrefix(etag, "W/")) {
+		return 0, size, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(strings.TrimPrefix(header, "bytes=")), "-")
+	if !found {
+		return 0, size, false, nil
+	}
+	if first == "" {
+		// suffix range, the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false, ErrRangeNotSatisfiable
+		}
+		n = min(n, size)
+		return size - n, n, true, nil
+	}
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false, ErrRangeNotSatisfiable
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false, ErrRangeNotSatisfiable
+		}
+		end = min(end, size-1)
+	}
+	return start, end - start + 1, true, nil
+}
+
+// the parts of the fragments making up [start, start+length) of their concatenation
+func spans(data []FragmentData, start, length int64) []span {
+	parts := []span{}
+	for _, d := range data {
+		if length == 0 {
+			break
+		}
+		if start >= d.Size() {
+			start -= d.Size()
+			continue
+		}
+		n := min(d.Size()-start, length)
+		parts = append(parts, span{d, start, n})
+		length -= n
+		start = 0
+	}
+	return parts
+}
+
+// ETag of the concatenation of the given fragments, which never change once complete
+func fragmentsETag(frags []*Fragment) string {
+	size := uint64(0)
+	for _, frag := range frags {
+		size += uint64(frag.ByteLength)
+	}
+	return fmt.Sprintf("\"%d-%d-%d\"", frags[0].Sequence, frags[0].Pts, size)
+}
+
+// writes the fragments one after the other, or the byte range asked for
+func (stream *InputStream) serveFile(w http.ResponseWriter, r *http.Request, data []FragmentData) {
+	size := int64(0)
+	for _, d := range data {
+		size += d.Size()
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	start, length, partial, err := byteRange(r, size, w.Header().Get("ETag"))
 	if err != nil {
-		fmt.Println("Failed to get TCP file:", err)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
 		return
 	}
-	defer tcpFile.Close()
-	tcpFd := int(tcpFile.Fd())
+	parts := spans(data, start, length)
 
-	for _, fd := range fds {
-		offset := int64(0)
-		for offset < size {
-			n, err := unix.Sendfile(tcpFd, int(fd.Fd()), &offset, int(size-offset))
-			if err != nil {
-				fmt.Println("sendfile failed:", err)
-				return
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", length))
+	if partial {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if err := writeSpans(w, parts); err != nil {
+		if errors.As(err, new(*SendfileError)) {
+			stream.metrics.sendfileErrors.Add(1)
+		}
+		stream.log.Warn("writing fragments", "path", r.URL.Path, "error", err)
+	}
+}
+
+// SendfileError is a failure reading file backed data, which net/http sends with sendfile on plain TCP connections,
+// the client going away while it is written is not one
+type SendfileError struct {
+	Err error
+}
+
+func (e *SendfileError) Error() string {
+	return "sendfile: " + e.Err.Error()
+}
+
+func (e *SendfileError) Unwrap() error {
+	return e.Err
+}
+
+// 256KB, a few fragments of a high bitrate representation
+var copyBuffers = sync.Pool{New: func() any { b := make([]byte, 256<<10); return &b }}
+
+// writes the spans in order: file backed data is handed to the ResponseWriter as a file, so that on a plain
+// TCP connection net/http sends it with sendfile; everything else (TLS, HTTP/2, heap data) is copied through a buffer
+func writeSpans(w io.Writer, parts []span) error {
+	buffer := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buffer)
+	for _, part := range parts {
+		if file := reopen(part.data); file != nil {
+			_, err := file.Seek(part.offset, io.SeekStart)
+			if err == nil {
+				_, err = io.CopyBuffer(w, &io.LimitedReader{R: file, N: part.length}, *buffer)
+			}
+			file.Close()
+			if err != nil && fileSideError(err) {
+				return &SendfileError{err}
 			}
-			if n == 0 {
-				break
+			if err != nil {
+				return err
 			}
+			continue
+		}
+		if _, err := io.CopyBuffer(w, io.NewSectionReader(part.data, part.offset, part.length), *buffer); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// the file could not be read: a read or seek on the copy path, or sendfile failing for another reason
+// than the connection, whose errors (EPIPE, ECONNRESET, deadlines) come wrapped the same way
+func fileSideError(err error) bool {
+	var syscallErr *os.SyscallError
+	if errors.As(err, &syscallErr) && syscallErr.Syscall == "sendfile" {
+		return !errors.Is(err, syscall.EPIPE) && !errors.Is(err, syscall.ECONNRESET) && !errors.Is(err, os.ErrDeadlineExceeded)
+	}
+	return errors.As(err, new(*fs.PathError))
+}
+
+// a private file description of the data, concurrent requests cannot share the file offset of the stored one
+func reopen(data FragmentData) *os.File {
+	f, ok := data.(interface{ Fd() uintptr })
+	if !ok {
+		return nil
+	}
+	file, err := os.Open(fmt.Sprintf("/proc/self/fd/%d", f.Fd()))
+	if err != nil {
+		return nil // no procfs, copied through a buffer instead
+	}
+	return file
 }
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// a representation of the given store holding 6 fragments, a keyframe every 2, served on plain HTTP or HTTP/2 over TLS
+func newTestServer(t *testing.T, store string, tls bool) (*InputStream, *httptest.Server) {
+	stream := newTestStream(t, store)
+	stream.Ingest(bytes.NewReader(testSource(6, 2)))
+	stream.Serve()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(stream.channel.route))
+	if tls {
+		server.EnableHTTP2 = true
+		server.StartTLS()
+	} else {
+		server.Start()
+	}
+	t.Cleanup(server.Close)
+	return stream, server
+}
+
+// the bytes ingested for the segment made of fragments first and first+1
+func testSegment(first uint32) []byte {
+	dt := uint64(first-1) * TEST_SAMPLES * TEST_SAMPLE_DURATION
+	return append(testFragment(first, dt, true), testFragment(first+1, dt+TEST_SAMPLES*TEST_SAMPLE_DURATION, false)...)
+}
+
+func TestServeSegment(t *testing.T) {
+	segment := testSegment(3)
+	size := len(segment)
+	split := len(testFragment(3, 0, true)) // where the second fragment starts
+	for _, store := range []string{STORE_HEAP, STORE_FILE, STORE_MEMFD} {
+		for _, tls := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/tls=%v", store, tls), func(t *testing.T) {
+				stream, server := newTestServer(t, store, tls)
+				etag := fragmentsETag([]*Fragment{stream.GetCompleteFragment(3), stream.GetCompleteFragment(4)})
+				// handed to net/http as a file, sent with sendfile on the plain TCP connection
+				if file := reopen(stream.GetCompleteFragment(3).data); file != nil {
+					file.Close()
+				} else if store != STORE_HEAP {
+					t.Fatalf("%s data not reopened through /proc/self/fd", store)
+				}
+				for _, test := range []struct {
+					name, rangeHeader, ifRange string
+					status                     int
+					body                       []byte
+				}{
+					{"whole", "", "", http.StatusOK, segment},
+					{"single", "bytes=10-99", "", http.StatusPartialContent, segment[10:100]},
+					{"across fragments", fmt.Sprintf("bytes=%d-%d", split-5, split+4), "", http.StatusPartialContent, segment[split-5 : split+5]},
+					{"open ended", fmt.Sprintf("bytes=%d-", split), "", http.StatusPartialContent, segment[split:]},
+					{"suffix", "bytes=-100", "", http.StatusPartialContent, segment[size-100:]},
+					{"suffix longer than the segment", fmt.Sprintf("bytes=-%d", size+10), "", http.StatusPartialContent, segment},
+					{"multi", "bytes=0-9,20-29", "", http.StatusOK, segment},
+					{"if-range current", "bytes=10-19", etag, http.StatusPartialContent, segment[10:20]},
+					{"if-range stale", "bytes=10-19", `"1-0-1"`, http.StatusOK, segment},
+					{"not satisfiable", fmt.Sprintf("bytes=%d-", size), "", http.StatusRequestedRangeNotSatisfiable, nil},
+				} {
+					request, _ := http.NewRequest(http.MethodGet, server.URL+"/test/v/3", nil)
+					if test.rangeHeader != "" {
+						request.Header.Set("Range", test.rangeHeader)
+					}
+					if test.ifRange != "" {
+						request.Header.Set("If-Range", test.ifRange)
+					}
+					response, err := server.Client().Do(request)
+					if err != nil {
+						t.Fatal(err)
+					}
+					body, err := io.ReadAll(response.Body)
+					response.Body.Close()
+					if err != nil {
+						t.Fatal(err)
+					}
+					if tls && response.ProtoMajor != 2 {
+						t.Fatalf("served over %s", response.Proto)
+					}
+					if response.StatusCode != test.status || (test.body != nil && !bytes.Equal(body, test.body)) {
+						t.Errorf("%s: status %d with %d bytes, want %d with %d bytes", test.name, response.StatusCode, len(body), test.status, len(test.body))
+					}
+				}
+				if errors := stream.metrics.sendfileErrors.Load(); errors != 0 {
+					t.Errorf("%d sendfile errors", errors)
+				}
+			})
+		}
+	}
+}
+
+type failingWriter struct {
+	err error
+}
+
+func (w failingWriter) Write(b []byte) (int, error) {
+	return 0, w.err
+}
+
+func TestWriteSpansErrors(t *testing.T) {
+	stream := newTestStream(t, STORE_FILE)
+	stream.Ingest(bytes.NewReader(testSource(2, 2)))
+	frag := stream.GetCompleteFragment(1)
+	parts := []span{{frag.data, 0, frag.data.Size()}}
+
+	// the client going away is not a failure of the file
+	err := writeSpans(failingWriter{&net.OpError{Op: "write", Net: "tcp", Err: syscall.EPIPE}}, parts)
+	if err == nil || errors.As(err, new(*SendfileError)) {
+		t.Errorf("client disconnection reported as %v", err)
+	}
+
+	// a file that cannot be read
+	dir, err := os.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	err = writeSpans(io.Discard, []span{{fileData{dir, 10}, 0, 10}})
+	if !errors.As(err, new(*SendfileError)) {
+		t.Errorf("unreadable file reported as %v", err)
+	}
+}
+
+func TestFileSideError(t *testing.T) {
+	sendfile := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "readfrom", Net: "tcp", Err: os.NewSyscallError("sendfile", errno)}
+	}
+	for err, want := range map[error]bool{
+		sendfile(syscall.EPIPE):      false,
+		sendfile(syscall.ECONNRESET): false,
+		sendfile(syscall.EIO):        true,
+		sendfile(syscall.EINVAL):     true,
+		&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}: false,
+		&net.OpError{Op: "write", Net: "tcp", Err: os.ErrDeadlineExceeded}:                     false,
+		&os.PathError{Op: "read", Path: "fragment", Err: syscall.EIO}:                          true,
+	} {
+		if got := fileSideError(err); got != want {
+			t.Errorf("%v: file side %v", err, got)
+		}
+	}
+}
+
+func TestServeInitGenerations(t *testing.T) {
+	stream, server := newTestServer(t, STORE_HEAP, false)
+	// the encoder restarts twice
+	stream.Ingest(bytes.NewReader(testSource(4, 2)))
+	stream.Ingest(bytes.NewReader(testSource(4, 2)))
+	get := func(path string) (*http.Response, string) {
+		response, err := http.Get(server.URL + "/test/v/" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return response, string(body)
+	}
+
+	for path, etag := range map[string]string{"init-1.mp4": `"init-1-`, "init-3.mp4": `"init-3-`, "init.mp4": `"init-3-`} {
+		response, body := get(path)
+		if response.StatusCode != http.StatusOK || !strings.HasPrefix(response.Header.Get("ETag"), etag) || body != string(stream.moov) {
+			t.Errorf("%s: status %d, ETag %s", path, response.StatusCode, response.Header.Get("ETag"))
+		}
+	}
+	if response, _ := get("init-4.mp4"); response.StatusCode != http.StatusNotFound {
+		t.Errorf("init-4.mp4: status %d", response.StatusCode)
+	}
+
+	// every discontinuity switches to the init segment of the new generation
+	_, playlist := get("playlist.m3u8")
+	for _, want := range []string{
+		"#EXT-X-MAP:URI=\"init-1.mp4\"\n#EXT-X-PROGRAM-DATE-TIME:",
+		"#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"init-2.mp4\"\n",
+		"#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"init-3.mp4\"\n",
+	} {
+		if !strings.Contains(playlist, want) {
+			t.Errorf("playlist without %q:\n%s", want, playlist)
+		}
+	}
+	if strings.Count(playlist, "#EXT-X-MAP") != 3 {
+		t.Errorf("playlist:\n%s", playlist)
+	}
+
+	// once their segments are evicted, older init segments are dropped
+	stream.Ingest(bytes.NewReader(testSource(4, 2)))
+	stream.Ingest(bytes.NewReader(testSource(4, 2)))
+	if response, _ := get("init-1.mp4"); response.StatusCode != http.StatusNotFound {
+		t.Errorf("init-1.mp4 of evicted segments: status %d", response.StatusCode)
+	}
+	if response, _ := get("init-5.mp4"); response.StatusCode != http.StatusOK {
+		t.Errorf("init-5.mp4: status %d", response.StatusCode)
+	}
+}
+
+func TestIngestHandler(t *testing.T) {
+	previous := config.Load()
+	t.Cleanup(func() { config.Store(previous) })
+	config.Store(&Config{Server: Server{IngestToken: "ingest"}})
+	stream := newTestStream(t, STORE_HEAP)
+	stream.channel.streams = []*InputStream{stream}
+	server := httptest.NewServer(ProtectIngest(stream.channel.IngestHandler))
+	t.Cleanup(server.Close)
+	put := func(method, reprId, token string, body io.Reader) *http.Response {
+		r, _ := http.NewRequest(method, server.URL+"/test/ingest/"+reprId, body)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		response, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response
+	}
+
+	if response := put(http.MethodPut, "v", "", bytes.NewReader(testSource(4, 2))); response.StatusCode != http.StatusUnauthorized || stream.moov != nil {
+		t.Errorf("upload without the token: status %d", response.StatusCode)
+	}
+	if response := put(http.MethodPut, "v", "admin", bytes.NewReader(testSource(4, 2))); response.StatusCode != http.StatusUnauthorized || stream.moov != nil {
+		t.Errorf("upload with a wrong token: status %d", response.StatusCode)
+	}
+	if response := put(http.MethodGet, "v", "ingest", nil); response.StatusCode != http.StatusMethodNotAllowed || response.Header.Get("Allow") != "PUT, POST" {
+		t.Errorf("GET: status %d, Allow %q", response.StatusCode, response.Header.Get("Allow"))
+	}
+	if response := put(http.MethodPut, "a", "ingest", bytes.NewReader(testSource(4, 2))); response.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown representation: status %d", response.StatusCode)
+	}
+	if response := put(http.MethodPost, "v", "ingest", bytes.NewReader(testSource(4, 2))); response.StatusCode != http.StatusNoContent || stream.GetCompleteFragment(4) == nil {
+		t.Errorf("upload: status %d", response.StatusCode)
+	}
+
+	// a second encoder is turned away while the first one is connected
+	reader, writer := io.Pipe()
+	done := make(chan *http.Response)
+	go func() { done <- put(http.MethodPut, "v", "ingest", reader) }()
+	writer.Write(testInit())
+	for deadline := time.Now().Add(time.Second); !stream.ingesting.Load() && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if response := put(http.MethodPut, "v", "ingest", bytes.NewReader(testSource(4, 2))); response.StatusCode != http.StatusConflict {
+		t.Errorf("concurrent upload: status %d", response.StatusCode)
+	}
+	writer.Close()
+	if response := <-done; response.StatusCode != http.StatusNoContent {
+		t.Errorf("first upload: status %d", response.StatusCode)
+	}
+
+	stream.Stop()
+	if response := put(http.MethodPut, "v", "ingest", bytes.NewReader(testSource(4, 2))); response.StatusCode != http.StatusGone {
+		t.Errorf("upload to a removed representation: status %d", response.StatusCode)
+	}
+}
+
+// a representation ingesting from a pipe, feed writes the next fragments (a keyframe every 2) and waits for their parsing
+func newLiveTestServer(t *testing.T) (*InputStream, *httptest.Server, func(seqs ...uint32)) {
+	stream := newTestStream(t, STORE_HEAP)
+	reader, writer := io.Pipe()
+	go stream.Ingest(reader)
+	t.Cleanup(func() { writer.Close() })
+	writer.Write(testInit())
+	stream.Serve()
+	server := httptest.NewServer(http.HandlerFunc(stream.channel.route))
+	t.Cleanup(server.Close)
+	feed := func(seqs ...uint32) {
+		for _, seq := range seqs {
+			writer.Write(testFragment(seq, uint64(seq-1)*TEST_SAMPLES*TEST_SAMPLE_DURATION, seq%2 == 1))
+			if !stream.WaitUntil(context.Background(), time.Second, func() bool { return stream.GetCompleteFragment(seq) != nil }) {
+				t.Fatalf("fragment %d not ingested", seq)
+			}
+		}
+	}
+	return stream, server, feed
+}
+
+func TestBlockingSegment(t *testing.T) {
+	previous := config.Load()
+	t.Cleanup(func() { config.Store(previous) })
+	_, server, feed := newLiveTestServer(t)
+	feed(1, 2, 3, 4)
+	get := func(path string) (int, []byte) {
+		response, err := http.Get(server.URL + "/test/v/" + path)
+		if err != nil {
+			t.Error(err)
+			return 0, nil
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return response.StatusCode, body
+	}
+
+	config.Store(&Config{})
+	if status, _ := get("5"); status != http.StatusNotFound {
+		t.Errorf("segment not produced yet without blocking: status %d", status)
+	}
+
+	config.Store(&Config{Server: Server{BlockingTimeout: 2000}})
+	type result struct {
+		status int
+		body   []byte
+	}
+	held := make(chan result)
+	go func() {
+		status, body := get("5")
+		held <- result{status, body}
+	}()
+	select {
+	case r := <-held:
+		t.Fatalf("segment 5 answered %d before being produced", r.status)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// complete once the next keyframe starts
+	feed(5, 6, 7)
+	if r := <-held; r.status != http.StatusOK || !bytes.Equal(r.body, testSegment(5)) {
+		t.Errorf("held segment 5: status %d, %d bytes", r.status, len(r.body))
+	}
+
+	start := time.Now()
+	if status, _ := get("20"); status != http.StatusNotFound || time.Since(start) > time.Second {
+		t.Errorf("segment beyond the horizon: status %d after %s", status, time.Since(start))
+	}
+	config.Store(&Config{Server: Server{BlockingTimeout: 100}})
+	start = time.Now()
+	if status, _ := get("9"); status != http.StatusNotFound || time.Since(start) < 100*time.Millisecond {
+		t.Errorf("segment not produced in time: status %d after %s", status, time.Since(start))
+	}
+}
+
+func TestChunkedSegment(t *testing.T) {
+	previous := config.Load()
+	t.Cleanup(func() { config.Store(previous) })
+	config.Store(&Config{Server: Server{BlockingTimeout: 2000, ChunkedSegments: true}})
+	_, server, feed := newLiveTestServer(t)
+	feed(1, 2, 3, 4, 5, 6, 7, 8)
+
+	responses := make(chan *http.Response)
+	go func() {
+		response, err := http.Get(server.URL + "/test/v/9")
+		if err != nil {
+			t.Error(err)
+		}
+		responses <- response
+	}()
+	feed(9)
+	response := <-responses
+	if response == nil {
+		t.FailNow()
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK || response.ContentLength != -1 {
+		t.Fatalf("status %d, Content-Length %d", response.StatusCode, response.ContentLength)
+	}
+	// the first fragment is delivered while the second one is not produced yet
+	segment := testSegment(9)
+	first := make([]byte, len(testFragment(9, 0, true)))
+	if _, err := io.ReadFull(response.Body, first); err != nil || !bytes.Equal(first, segment[:len(first)]) {
+		t.Fatalf("first fragment: %v", err)
+	}
+	feed(10, 11)
+	rest, err := io.ReadAll(response.Body)
+	if err != nil || !bytes.Equal(append(first, rest...), segment) {
+		t.Errorf("segment of %d bytes streamed as %d, %v", len(segment), len(first)+len(rest), err)
+	}
+}
+
+func TestExactTimestamps(t *testing.T) {
+	// four months into a 90 kHz timeline, where a float32 in seconds is off by minutes
+	const start = 1<<40 + 1
+	stream := newTestStream(t, STORE_HEAP)
+	stream.channel.streams = []*InputStream{stream}
+	source := testInit()
+	for i := 0; i < 6; i++ {
+		source = append(source, testFragment(uint32(i+1), start+uint64(i*TEST_SAMPLES*TEST_SAMPLE_DURATION), i%2 == 0)...)
+	}
+	stream.Ingest(bytes.NewReader(source))
+	stream.Serve()
+	server := httptest.NewServer(http.HandlerFunc(stream.channel.route))
+	t.Cleanup(server.Close)
+
+	third := uint64(start + 2*TEST_SAMPLES*TEST_SAMPLE_DURATION)
+	if frag := stream.GetCompleteFragment(3); frag.Pts != third || frag.Timescale != TEST_TIMESCALE {
+		t.Errorf("fragment 3 at %d/%d, %d expected", frag.Pts, frag.Timescale, third)
+	}
+	response, err := http.Get(server.URL + "/test/v/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if pts, timescale := response.Header.Get("Ruddr-Pts"), response.Header.Get("Ruddr-Timescale"); pts != strconv.FormatUint(third, 10) || timescale != "90000" {
+		t.Errorf("Ruddr-Pts %s, Ruddr-Timescale %s", pts, timescale)
+	}
+
+	response, err = http.Get(server.URL + "/test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var manifest struct {
+		Keyframes map[string][]struct {
+			Sequence  uint32      `json:"seq"`
+			Pts       json.Number `json:"pts"`
+			Timescale uint32      `json:"timescale"`
+		} `json:"keyframes"`
+	}
+	decoder := json.NewDecoder(response.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&manifest); err != nil {
+		t.Fatal(err)
+	}
+	for i, keyframe := range manifest.Keyframes["v"] {
+		if expected := strconv.FormatUint(start+uint64(2*i*TEST_SAMPLES*TEST_SAMPLE_DURATION), 10); keyframe.Pts.String() != expected {
+			t.Errorf("keyframe %d at %s in the manifest, %s expected", keyframe.Sequence, keyframe.Pts, expected)
+		}
+	}
+	if len(manifest.Keyframes["v"]) != 3 {
+		t.Errorf("manifest keyframes %+v", manifest.Keyframes)
+	}
+
+	// the same instant in another timescale falls into the same forecast window
+	audio := &Fragment{Pts: Rescale(third, TEST_TIMESCALE, 48000), Timescale: 48000}
+	if video, other := stream.channel.windowKey(stream.GetCompleteFragment(3)), stream.channel.windowKey(audio); video != other {
+		t.Errorf("window %d of the video, %d of the audio", video, other)
+	}
+}
@@ -2,15 +2,23 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"sync"
+	"sync/atomic"
 )
 
+// Event is a message to the SSE clients, sent with an event field when Name is set (for addEventListener)
+type Event struct {
+	Name string
+	Data []byte
+}
+
 // Client represents a connected SSE client
 type Client struct {
 	ID     string
-	Events chan []byte // Each client needs its own buffer to receive events from the broadcaster
+	Events chan Event // Each client needs its own buffer to receive events from the broadcaster
 }
 
 // Broadcaster manages SSE clients and broadcasts events
@@ -19,15 +27,17 @@ type Broadcaster struct {
 	clientsMutex   sync.RWMutex
 	registerChan   chan *Client
 	unregisterChan chan *Client
-	broadcastChan  <-chan []byte // Input channel only
+	broadcastChan  <-chan Event // Input channel only
 	shutdown       chan struct{}
 	isRunning      bool
 	runningMutex   sync.Mutex
+	dropped        atomic.Uint64 // events not delivered to slow clients
+	log            *slog.Logger
 }
 
 // NewBroadcaster creates a new SSE broadcaster
 // The broadcastChan parameter allows using an external channel as event source
-func NewBroadcaster(broadcastChan <-chan []byte) *Broadcaster {
+func NewBroadcaster(broadcastChan <-chan Event, logger *slog.Logger) *Broadcaster {
 	return &Broadcaster{
 		clients:        make(map[*Client]bool),
 		clientsMutex:   sync.RWMutex{},
@@ -36,12 +46,13 @@ func NewBroadcaster(broadcastChan <-chan []byte) *Broadcaster {
 		broadcastChan:  broadcastChan,
 		shutdown:       make(chan struct{}),
 		isRunning:      false,
+		log:            logger,
 	}
 }
 
 // Start begins the broadcaster's main loop
 // If broadcastChan is nil in the constructor, you must provide it here
-func (b *Broadcaster) Start(broadcastChan ...<-chan []byte) error {
+func (b *Broadcaster) Start(broadcastChan ...<-chan Event) error {
 	b.runningMutex.Lock()
 	defer b.runningMutex.Unlock()
 
@@ -68,7 +79,7 @@ func (b *Broadcaster) Start(broadcastChan ...<-chan []byte) error {
 				b.clientsMutex.Lock()
 				b.clients[client] = true
 				b.clientsMutex.Unlock()
-				log.Printf("Client %s connected, total clients: %d", client.ID, len(b.clients))
+				b.log.Info("client connected", "client", client.ID, "clients", len(b.clients))
 
 			case client := <-b.unregisterChan:
 				b.clientsMutex.Lock()
@@ -77,12 +88,12 @@ func (b *Broadcaster) Start(broadcastChan ...<-chan []byte) error {
 					close(client.Events)
 				}
 				b.clientsMutex.Unlock()
-				log.Printf("Client %s disconnected, total clients: %d", client.ID, len(b.clients))
+				b.log.Info("client disconnected", "client", client.ID, "clients", len(b.clients))
 
 			case event, ok := <-b.broadcastChan:
 				if !ok {
 					// Input channel was closed, shutdown the broadcaster
-					log.Printf("Broadcast channel closed, shutting down broadcaster")
+					b.log.Warn("broadcast channel closed, shutting down broadcaster")
 					b.Stop()
 					return
 				}
@@ -96,7 +107,8 @@ func (b *Broadcaster) Start(broadcastChan ...<-chan []byte) error {
 						// Event successfully sent to this client's buffer
 					default:
 						// Client's buffer is full (client is too slow)
-						log.Printf("Dropping event for slow client %s", client.ID)
+						b.dropped.Add(1)
+						b.log.Warn("dropping event for slow client", "client", client.ID)
 					}
 				}
 				b.clientsMutex.RUnlock()
@@ -147,6 +159,11 @@ func (b *Broadcaster) ClientCount() int {
 	return len(b.clients)
 }
 
+// DroppedEvents returns how many events were dropped for slow clients
+func (b *Broadcaster) DroppedEvents() uint64 {
+	return b.dropped.Load()
+}
+
 // IsRunning returns whether the broadcaster is currently running
 func (b *Broadcaster) IsRunning() bool {
 	b.runningMutex.Lock()
@@ -161,7 +178,6 @@ func (b *Broadcaster) HandlerFunc() http.HandlerFunc {
 		w.Header().Set("Content-Type", "text/event-stream")
 		w.Header().Set("Cache-Control", "no-cache")
 		w.Header().Set("Connection", "keep-alive")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
 
 		// Flush headers immediately
 		if flusher, ok := w.(http.Flusher); ok {
@@ -174,7 +190,7 @@ func (b *Broadcaster) HandlerFunc() http.HandlerFunc {
 		// Create a client with a buffered channel
 		client := &Client{
 			ID:     r.RemoteAddr,
-			Events: make(chan []byte, 10), // Buffer for this specific client
+			Events: make(chan Event, 10), // Buffer for this specific client
 		}
 
 		// Register the client
@@ -203,7 +219,7 @@ func (b *Broadcaster) HandlerFunc() http.HandlerFunc {
 				if !ok {
 					return
 				}
-				fmt.Fprintf(w, "data: %s\n\n", event)
+				writeEvent(w, event)
 				if f, ok := w.(http.Flusher); ok {
 					f.Flush()
 				}
@@ -213,3 +229,11 @@ func (b *Broadcaster) HandlerFunc() http.HandlerFunc {
 		}
 	}
 }
+
+// writes an event in the text/event-stream format, unnamed events are dispatched as "message"
+func writeEvent(w io.Writer, event Event) {
+	if event.Name != "" {
+		fmt.Fprintf(w, "event: %s\n", event.Name)
+	}
+	fmt.Fprintf(w, "data: %s\n\n", event.Data)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBroadcasterNamedEvents(t *testing.T) {
+	events := make(chan Event)
+	broadcaster := NewBroadcaster(events, mainLog)
+	if err := broadcaster.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer broadcaster.Stop()
+	server := httptest.NewServer(broadcaster.HandlerFunc())
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	lines := bufio.NewScanner(response.Body)
+	read := func(n int) []string {
+		got := []string{}
+		for len(got) < n && lines.Scan() {
+			got = append(got, lines.Text())
+		}
+		return got
+	}
+	// registered once connected
+	if got := read(2); len(got) != 2 || got[0] != `data: {"type":"connected"}` {
+		t.Fatalf("connection %q", got)
+	}
+
+	events <- Event{Data: []byte(`{"seq":1}`)}
+	events <- Event{Name: "discontinuity", Data: []byte(`{"seq":2}`)}
+	want := []string{`data: {"seq":1}`, "", "event: discontinuity", `data: {"seq":2}`, ""}
+	got := read(len(want))
+	for i := range want {
+		if i >= len(got) || got[i] != want[i] {
+			t.Fatalf("stream %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/justincormack/go-memfd"
+)
+
+const (
+	STORE_MEMFD = "memfd" // sealed anonymous memory files, served with sendfile
+	STORE_HEAP  = "heap"  // plain byte slices, no kernel features needed
+	STORE_FILE  = "file"  // unlinked temporary files in Ingester.StoreDirectory
+)
+
+// FragmentStore holds the fragments of a representation while they are in the live window
+type FragmentStore interface {
+	// Put indexes a fragment as soon as its moof is parsed, its data is written once the mdat arrives
+	Put(frag *Fragment)
+	Get(seq uint32) (*Fragment, bool)
+	Delete(seq uint32)
+	// Write stores moof and mdat as the data of the fragment, making it complete
+	Write(frag *Fragment, mdat []byte) error
+	// Range walks the fragments in sequence order until yield returns false
+	Range(yield func(*Fragment) bool)
+	// Keyframes walks the complete keyframes in sequence order until yield returns false
+	Keyframes(yield func(*Fragment) bool)
+	// Evict removes the fragments up to max and returns them in sequence order, their data still to be closed
+	Evict(max uint32) []*Fragment
+}
+
+// FragmentData is the content (moof + mdat) of a complete fragment
+type FragmentData interface {
+	io.ReaderAt
+	Size() int64
+	Close() error
+}
+
+// NewFragmentStore creates a store of the given kind, dir is used by the file store only
+func NewFragmentStore(kind string, dir string) (FragmentStore, error) {
+	switch kind {
+	case "", STORE_MEMFD:
+		// fail at startup rather than at the first fragment on kernels without memfd_create
+		probe, err := memfd.Create()
+		if err != nil {
+			return nil, fmt.Errorf("memfd not available: %w", err)
+		}
+		probe.Close()
+		return &memfdStore{}, nil
+	case STORE_HEAP:
+		return &heapStore{}, nil
+	case STORE_FILE:
+		if dir == "" {
+			dir = os.TempDir()
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		return &fileStore{dir: dir}, nil
+	default:
+		return nil, fmt.Errorf("unknown fragment store %q", kind)
+	}
+}
+
+// fragmentIndex is the sequence number index shared by all the stores, only the way data is kept differs
+type fragmentIndex struct {
+	fragments sync.Map
+}
+
+func (index *fragmentIndex) Put(frag *Fragment) {
+	index.fragments.Store(frag.Sequence, frag)
+}
+
+func (index *fragmentIndex) Get(seq uint32) (*Fragment, bool) {
+	if val, ok := index.fragments.Load(seq); ok {
+		return val.(*Fragment), true
+	}
+	return nil, false
+}
+
+func (index *fragmentIndex) Delete(seq uint32) {
+	index.fragments.Delete(seq)
+}
+
+// sync.Map has no order, fragments are collected and sorted first
+func (index *fragmentIndex) sorted() []*Fragment {
+	fragments := []*Fragment{}
+	index.fragments.Range(func(key, value interface{}) bool {
+		fragments = append(fragments, value.(*Fragment))
+		return true
+	})
+	sort.Slice(fragments, func(i, j int) bool { return fragments[i].Sequence < fragments[j].Sequence })
+	return fragments
+}
+
+func (index *fragmentIndex) Range(yield func(*Fragment) bool) {
+	for _, frag := range index.sorted() {
+		if !yield(frag) {
+			return
+		}
+	}
+}
+
+func (index *fragmentIndex) Keyframes(yield func(*Fragment) bool) {
+	for _, frag := range index.sorted() {
+		if frag.Keyframe && frag.data != nil && !yield(frag) {
+			return
+		}
+	}
+}
+
+func (index *fragmentIndex) Evict(max uint32) []*Fragment {
+	evicted := []*Fragment{}
+	for _, frag := range index.sorted() {
+		if frag.Sequence > max {
+			break
+		}
+		index.fragments.Delete(frag.Sequence)
+		evicted = append(evicted, frag)
+	}
+	return evicted
+}
+
+type memfdStore struct {
+	fragmentIndex
+}
+
+type memfdData struct {
+	*memfd.Memfd
+	size int64
+}
+
+func (data memfdData) Size() int64 { return data.size }
+
+func (data memfdData) Close() error {
+	data.Unmap()
+	return data.Memfd.Close()
+}
+
+func (store *memfdStore) Write(frag *Fragment, mdat []byte) error {
+	file, err := memfd.Create()
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(frag.moof); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Write(mdat); err != nil {
+		file.Close()
+		return err
+	}
+	// the size cannot change once sealed
+	if err := file.SetSize(int64(frag.ByteLength)); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.SetImmutable(); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	frag.data = memfdData{file, int64(frag.ByteLength)}
+	return nil
+}
+
+type heapStore struct {
+	fragmentIndex
+}
+
+type heapData struct {
+	*bytes.Reader
+}
+
+func (data heapData) Close() error { return nil }
+
+func (store *heapStore) Write(frag *Fragment, mdat []byte) error {
+	frag.data = heapData{bytes.NewReader(append(frag.moof[:len(frag.moof):len(frag.moof)], mdat...))}
+	return nil
+}
+
+type fileStore struct {
+	fragmentIndex
+	dir string
+}
+
+// fileData is a regular file holding a fragment, sendfile works on it as on a memfd
+type fileData struct {
+	*os.File
+	size int64
+}
+
+func (data fileData) Size() int64 { return data.size }
+
+func (store *fileStore) Write(frag *Fragment, mdat []byte) error {
+	file, err := os.CreateTemp(store.dir, "fragment-*.m4s")
+	if err != nil {
+		return err
+	}
+	// unlinked right away, the space is given back as soon as the fragment is closed
+	os.Remove(file.Name())
+	if _, err := file.Write(frag.moof); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Write(mdat); err != nil {
+		file.Close()
+		return err
+	}
+	frag.data = fileData{file, int64(frag.ByteLength)}
+	return nil
+}
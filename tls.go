@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const CERT_POLL_INTERVAL = 10 * time.Second // how often certificate files are checked for changes
+
+// certReloader serves the certificate currently on disk, reloading it on SIGHUP or when the files change
+type certReloader struct {
+	certFile, keyFile string
+	mu                sync.RWMutex
+	cert              *tls.Certificate
+	modTime           time.Time
+	log               *slog.Logger
+}
+
+func newCertReloader(certFile, keyFile string, log *slog.Logger) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile, log: log}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// the previous certificate is kept when the new pair is not valid (e.g. caught halfway through a renewal)
+func (reloader *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return err
+	}
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+	reloader.cert = &cert
+	reloader.modTime = reloader.lastChange()
+	return nil
+}
+
+func (reloader *certReloader) lastChange() time.Time {
+	last := time.Time{}
+	for _, path := range []string{reloader.certFile, reloader.keyFile} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last
+}
+
+func (reloader *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mu.RLock()
+	defer reloader.mu.RUnlock()
+	return reloader.cert, nil
+}
+
+// Watch reloads the certificate on SIGHUP and whenever the files are modified
+func (reloader *certReloader) Watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(CERT_POLL_INTERVAL)
+	defer ticker.Stop()
+	reloader.watch(hup, ticker.C)
+}
+
+// reloads the certificate on every signal, and on every tick finding the files modified, until hup is closed
+func (reloader *certReloader) watch(hup <-chan os.Signal, tick <-chan time.Time) {
+	for {
+		select {
+		case _, ok := <-hup:
+			if !ok {
+				return
+			}
+		case <-tick:
+			reloader.mu.RLock()
+			unchanged := !reloader.lastChange().After(reloader.modTime)
+			reloader.mu.RUnlock()
+			if unchanged {
+				continue
+			}
+		}
+		if err := reloader.load(); err != nil {
+			reloader.log.Error("reloading certificate", "error", err)
+			continue
+		}
+		reloader.log.Info("certificate reloaded", "cert", reloader.certFile)
+	}
+}
+
+// ListenAndServe serves on plain HTTP, or on HTTPS with HTTP/2 when a certificate is configured
+func (server Server) ListenAndServe(handler http.Handler) error {
+	if server.TLSCert == "" {
+		return http.ListenAndServe(server.Address, handler)
+	}
+	reloader, err := newCertReloader(server.TLSCert, server.TLSKey, config.Load().Log.ComponentLogger("tls"))
+	if err != nil {
+		return fmt.Errorf("loading certificate: %w", err)
+	}
+	go reloader.Watch()
+
+	if server.RedirectAddress != "" {
+		go func() {
+			if err := http.ListenAndServe(server.RedirectAddress, http.HandlerFunc(server.redirectToHTTPS)); err != nil {
+				reloader.log.Error("serving HTTPS redirect", "address", server.RedirectAddress, "error", err)
+			}
+		}()
+	}
+
+	// net/http negotiates HTTP/2 over ALPN by itself when serving TLS
+	httpsServer := &http.Server{
+		Addr:      server.Address,
+		Handler:   handler,
+		TLSConfig: &tls.Config{GetCertificate: reloader.GetCertificate, MinVersion: tls.VersionTLS12},
+	}
+	return httpsServer.ListenAndServeTLS("", "")
+}
+
+// permanent redirect to the same resource on the HTTPS listener, 308 keeps the method and body of PUT/POST ingest
+func (server Server) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host // no port in the request
+	}
+	if _, port, err := net.SplitHostPort(server.Address); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writes a self-signed certificate for the given common name, modified at the given time
+func writeTestCert(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, block := range map[string]*pem.Block{certFile: {Type: "CERTIFICATE", Bytes: der}, keyFile: {Type: "EC PRIVATE KEY", Bytes: keyDer}} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Minute)
+	writeTestCert(t, certFile, keyFile, "first", start)
+	reloader, err := newCertReloader(certFile, keyFile, mainLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hup, tick := make(chan os.Signal), make(chan time.Time)
+	defer close(hup)
+	go reloader.watch(hup, tick)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{GetCertificate: reloader.GetCertificate}
+	server.StartTLS()
+	defer server.Close()
+	served := func() string {
+		// with SNI, GetCertificate is asked instead of the test certificate of httptest
+		tlsConfig := &tls.Config{ServerName: "ruddr.test", InsecureSkipVerify: true}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true}}
+		response, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if name := served(); name != "first" {
+		t.Fatalf("serving %s", name)
+	}
+
+	// renewed on disk, picked up by the next poll
+	writeTestCert(t, certFile, keyFile, "renewed", start.Add(time.Second))
+	tick <- time.Now()
+	tick <- time.Now() // the first tick has been handled once the second one is received
+	if name := served(); name != "renewed" {
+		t.Errorf("serving %s after the files changed", name)
+	}
+
+	// a pair caught halfway through a renewal keeps the previous certificate
+	os.WriteFile(keyFile, []byte("garbage"), 0600)
+	os.Chtimes(keyFile, start.Add(2*time.Second), start.Add(2*time.Second))
+	tick <- time.Now()
+	tick <- time.Now()
+	if name := served(); name != "renewed" {
+		t.Errorf("serving %s after an invalid renewal", name)
+	}
+
+	// SIGHUP reloads even without a newer modification time
+	writeTestCert(t, certFile, keyFile, "signaled", start)
+	hup <- syscall.SIGHUP
+	tick <- time.Now()
+	if name := served(); name != "signaled" {
+		t.Errorf("serving %s after SIGHUP", name)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	for address, location := range map[string]string{
+		":8443": "https://example.com:8443/mux/ingest/v?token=1",
+		":443":  "https://example.com/mux/ingest/v?token=1",
+	} {
+		server := httptest.NewServer(http.HandlerFunc(Server{Address: address}.redirectToHTTPS))
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		// an encoder pushing to the plain HTTP port must keep its method and body
+		request, _ := http.NewRequest(http.MethodPut, server.URL+"/mux/ingest/v?token=1", strings.NewReader("fragments"))
+		request.Host = "example.com:80"
+		response, err := client.Do(request)
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusPermanentRedirect || response.Header.Get("Location") != location {
+			t.Errorf("%s: %d to %s", address, response.StatusCode, response.Header.Get("Location"))
+		}
+	}
+}